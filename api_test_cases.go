@@ -347,6 +347,32 @@ var apiTestCases = []apiTestCase{
 			},
 		},
 	},
+	// the step keeps the reference but runs with the var's value
+	apiTestCase{
+		requestBody: `{
+	  "name": "Pipeline Name",
+	  "vars": {"file": "notafile.txt"},
+	  "steps": [
+	    {
+	      "name": "Step Name",
+	      "image": "ubuntu:14.04",
+	      "cmds": ["ls ${file}"]
+	    }
+	  ]
+	}`,
+		pipeline: Pipeline{
+			Name:   "Pipeline Name",
+			Status: StatusFailed,
+			Steps: []*Step{
+				&Step{
+					Name:      "Step Name",
+					ImageName: "ubuntu:14.04",
+					Cmds:      []Cmd{"ls ${file}"},
+					Status:    StatusFailed,
+				},
+			},
+		},
+	},
 	apiTestCase{
 		requestBody: `{
 	  "name": "Pipeline Name",
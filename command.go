@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+var (
+	errUnterminatedQuote = fmt.Errorf("Unterminated quote")
+	errTrailingEscape    = fmt.Errorf("Unterminated escape at end of command")
+)
+
+// UnmarshalJSON implements json.Unmarshaler. A command is either
+// a string parsed like a shell would, or an array of the arguments
+// which is kept as the equivalent quoted string.
+func (c *Cmd) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = Cmd(s)
+		return nil
+	}
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		return fmt.Errorf("Command must be a string or an array of strings")
+	}
+	*c = quoteCommand(args)
+	return nil
+}
+
+// splitCommand splits a command into its arguments using the
+// POSIX shell rules for words, quotes and backslash escapes.
+// No expansions are done and operators such as pipes are
+// ordinary arguments, steps which need them set shell.
+func splitCommand(cmd string) ([]string, error) {
+	var args []string
+	var arg []rune
+	// inArg is set once an argument has started, even
+	// if it's empty so far, so that "" is an argument
+	inArg := false
+	runes := []rune(cmd)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		case r == '\\':
+			i++
+			if i == len(runes) {
+				return nil, errTrailingEscape
+			}
+			// an escaped newline continues the line
+			if runes[i] != '\n' {
+				arg = append(arg, runes[i])
+				inArg = true
+			}
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, errUnterminatedQuote
+			}
+			arg = append(arg, runes[i+1:end]...)
+			inArg = true
+			i = end
+		case r == '"':
+			inArg = true
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				// in double quotes a backslash only escapes these
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("$`\"\\\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				arg = append(arg, runes[i])
+			}
+			if i == len(runes) {
+				return nil, errUnterminatedQuote
+			}
+		default:
+			arg = append(arg, r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// quoteCommand returns a command which splits into args
+func quoteCommand(args []string) Cmd {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quoteArg(arg)
+	}
+	return Cmd(strings.Join(quoted, " "))
+}
+
+func quoteArg(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	safe := true
+	for _, r := range arg {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
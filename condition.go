@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// WhenOnSuccess runs the step only if the pipeline hasn't
+	// failed and its dependencies were successful. This is the default.
+	WhenOnSuccess = "on_success"
+	// WhenOnFailure runs the step once its dependencies have
+	// finished, but only if the pipeline has failed
+	WhenOnFailure = "on_failure"
+	// WhenAlways runs the step once its dependencies
+	// have finished, whatever their outcome
+	WhenAlways = "always"
+)
+
+// conditionEnv provides the values a condition is evaluated against
+type conditionEnv interface {
+	stepStatus(name string) Status
+	pipelineField(name string) string
+	pipelineVar(name string) string
+	failing() bool
+}
+
+// condition is a parsed Step.When expression. Conditions are
+// only evaluated once all of the step's dependencies have finished.
+//
+// The grammar is
+//
+//	expr       = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" expr ")" | "true" | "false" |
+//	             "failure()" | "success()" | value ("==" | "!=") value
+//	value      = string | "status(" string ")" | "pipeline." ident | "vars." ident
+//
+// where status gives the status of one of the step's dependencies,
+// pipeline.status and pipeline.name are supported and vars gives
+// the value of one of the pipeline's vars
+type condition interface {
+	eval(env conditionEnv) bool
+}
+
+func isOnSuccess(when string) bool {
+	return when == "" || when == WhenOnSuccess
+}
+
+// conditionRefs are what a condition refers to
+type conditionRefs struct {
+	// steps are the names of the steps given to status()
+	steps []string
+	// vars are the names of the pipeline's vars
+	vars []string
+}
+
+// parseCondition parses a Step.When value, returning
+// the condition and what it refers to
+func parseCondition(when string) (condition, conditionRefs, error) {
+	switch when {
+	case WhenOnFailure:
+		return failureCondition{}, conditionRefs{}, nil
+	case WhenAlways:
+		return literalCondition(true), conditionRefs{}, nil
+	}
+	tokens, err := tokenizeCondition(when)
+	if err != nil {
+		return nil, conditionRefs{}, err
+	}
+	p := &conditionParser{tokens: tokens}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, conditionRefs{}, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, conditionRefs{}, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return cond, p.refs, nil
+}
+
+type literalCondition bool
+
+func (c literalCondition) eval(env conditionEnv) bool {
+	return bool(c)
+}
+
+type failureCondition struct{}
+
+func (c failureCondition) eval(env conditionEnv) bool {
+	return env.failing()
+}
+
+type notCondition struct {
+	cond condition
+}
+
+func (c notCondition) eval(env conditionEnv) bool {
+	return !c.cond.eval(env)
+}
+
+type andCondition struct {
+	left, right condition
+}
+
+func (c andCondition) eval(env conditionEnv) bool {
+	return c.left.eval(env) && c.right.eval(env)
+}
+
+type orCondition struct {
+	left, right condition
+}
+
+func (c orCondition) eval(env conditionEnv) bool {
+	return c.left.eval(env) || c.right.eval(env)
+}
+
+type compareCondition struct {
+	left, right conditionValue
+	equal       bool
+}
+
+func (c compareCondition) eval(env conditionEnv) bool {
+	return (c.left.value(env) == c.right.value(env)) == c.equal
+}
+
+// conditionValue is a string valued part of a condition
+type conditionValue interface {
+	value(env conditionEnv) string
+}
+
+type literalValue string
+
+func (v literalValue) value(env conditionEnv) string {
+	return string(v)
+}
+
+type stepStatusValue string
+
+func (v stepStatusValue) value(env conditionEnv) string {
+	return string(env.stepStatus(string(v)))
+}
+
+type pipelineFieldValue string
+
+func (v pipelineFieldValue) value(env conditionEnv) string {
+	return env.pipelineField(string(v))
+}
+
+type pipelineVarValue string
+
+func (v pipelineVarValue) value(env conditionEnv) string {
+	return env.pipelineVar(string(v))
+}
+
+type conditionTokenKind int
+
+const (
+	tokenIdent conditionTokenKind = iota
+	tokenString
+	tokenOperator
+)
+
+type conditionToken struct {
+	kind conditionTokenKind
+	text string
+}
+
+func tokenizeCondition(s string) ([]conditionToken, error) {
+	var tokens []conditionToken
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, conditionToken{tokenString, string(runes[i+1 : end])})
+			i = end + 1
+		case unicode.IsLetter(r) || r == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, conditionToken{tokenIdent, string(runes[i:end])})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "&&", "||", "!", "(", ")", "."} {
+				if strings.HasPrefix(string(runes[i:]), candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", string(r))
+			}
+			tokens = append(tokens, conditionToken{tokenOperator, op})
+			i += len([]rune(op))
+		}
+	}
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+	refs   conditionRefs
+}
+
+func (p *conditionParser) peek() (conditionToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return conditionToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *conditionParser) accept(kind conditionTokenKind, text string) bool {
+	token, ok := p.peek()
+	if ok && token.kind == kind && token.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) expect(kind conditionTokenKind, text string) error {
+	if !p.accept(kind, text) {
+		return p.unexpected(fmt.Sprintf("%q", text))
+	}
+	return nil
+}
+
+func (p *conditionParser) unexpected(expected string) error {
+	token, ok := p.peek()
+	if !ok {
+		return fmt.Errorf("expected %s but reached the end", expected)
+	}
+	return fmt.Errorf("expected %s but found %q", expected, token.text)
+}
+
+func (p *conditionParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenOperator, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokenOperator, "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseUnary() (condition, error) {
+	if p.accept(tokenOperator, "!") {
+		cond, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{cond}, nil
+	}
+	if p.accept(tokenOperator, "(") {
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return cond, p.expect(tokenOperator, ")")
+	}
+	switch {
+	case p.accept(tokenIdent, "true"):
+		return literalCondition(true), nil
+	case p.accept(tokenIdent, "false"):
+		return literalCondition(false), nil
+	case p.accept(tokenIdent, "failure"):
+		return failureCondition{}, p.expectCall()
+	case p.accept(tokenIdent, "success"):
+		return notCondition{failureCondition{}}, p.expectCall()
+	}
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	equal := true
+	if p.accept(tokenOperator, "!=") {
+		equal = false
+	} else if !p.accept(tokenOperator, "==") {
+		return nil, p.unexpected(`"==" or "!="`)
+	}
+	right, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return compareCondition{left, right, equal}, nil
+}
+
+func (p *conditionParser) expectCall() error {
+	if err := p.expect(tokenOperator, "("); err != nil {
+		return err
+	}
+	return p.expect(tokenOperator, ")")
+}
+
+func (p *conditionParser) parseValue() (conditionValue, error) {
+	token, ok := p.peek()
+	if !ok {
+		return nil, p.unexpected("a value")
+	}
+	switch {
+	case token.kind == tokenString:
+		p.pos++
+		return literalValue(token.text), nil
+	case p.accept(tokenIdent, "status"):
+		if err := p.expect(tokenOperator, "("); err != nil {
+			return nil, err
+		}
+		name, ok := p.peek()
+		if !ok || name.kind != tokenString {
+			return nil, p.unexpected("a step name")
+		}
+		p.pos++
+		p.refs.steps = append(p.refs.steps, name.text)
+		return stepStatusValue(name.text), p.expect(tokenOperator, ")")
+	case p.accept(tokenIdent, "pipeline"):
+		if err := p.expect(tokenOperator, "."); err != nil {
+			return nil, err
+		}
+		field, ok := p.peek()
+		if !ok || (field.text != "status" && field.text != "name") {
+			return nil, p.unexpected("pipeline.status or pipeline.name")
+		}
+		p.pos++
+		return pipelineFieldValue(field.text), nil
+	case p.accept(tokenIdent, "vars"):
+		if err := p.expect(tokenOperator, "."); err != nil {
+			return nil, err
+		}
+		name, ok := p.peek()
+		if !ok || name.kind != tokenIdent {
+			return nil, p.unexpected("a var name")
+		}
+		p.pos++
+		p.refs.vars = append(p.refs.vars, name.text)
+		return pipelineVarValue(name.text), nil
+	}
+	return nil, p.unexpected("a value")
+}
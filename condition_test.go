@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeConditionEnv struct {
+	statuses map[string]Status
+	fields   map[string]string
+	vars     map[string]string
+	failed   bool
+}
+
+func (env fakeConditionEnv) stepStatus(name string) Status    { return env.statuses[name] }
+func (env fakeConditionEnv) pipelineField(name string) string { return env.fields[name] }
+func (env fakeConditionEnv) pipelineVar(name string) string   { return env.vars[name] }
+func (env fakeConditionEnv) failing() bool                    { return env.failed }
+
+func TestSmallCondition(t *testing.T) {
+	env := fakeConditionEnv{
+		statuses: map[string]Status{"build": StatusSuccessful, "test step": StatusFailed},
+		fields:   map[string]string{"name": "nightly", "status": "stopping"},
+		vars:     map[string]string{"branch": "master"},
+		failed:   true,
+	}
+	cases := []struct {
+		when     string
+		expected bool
+		refs     []string
+		vars     []string
+	}{
+		{WhenAlways, true, nil, nil},
+		{WhenOnFailure, true, nil, nil},
+		{`success()`, false, nil, nil},
+		{`status("test step") == "failed"`, true, []string{"test step"}, nil},
+		{`status('build') != 'successful'`, false, []string{"build"}, nil},
+		{`!(pipeline.name == "nightly") || failure() && true`, true, nil, nil},
+		{`pipeline.status == "running" && status("build") == "successful"`, false, []string{"build"}, nil},
+		{`vars.branch == "master" && vars.deploy != "false"`, true, nil, []string{"branch", "deploy"}},
+	}
+	for i, tc := range cases {
+		cond, refs, err := parseCondition(tc.when)
+		if !assert.Nil(t, err, "Case %d: Condition should parse", i) {
+			continue
+		}
+		assert.Equal(t, tc.expected, cond.eval(env), "Case %d: Condition result should match", i)
+		assert.Equal(t, tc.refs, refs.steps, "Case %d: Step references should match", i)
+		assert.Equal(t, tc.vars, refs.vars, "Case %d: Var references should match", i)
+	}
+
+	for i, when := range []string{`status(build) == "x"`, `"a" ==`, `pipeline.id == "1"`, `"a" == "b" &&`, `(true`, `"unterminated`, `vars.`, `vars."branch" == "x"`} {
+		_, _, err := parseCondition(when)
+		assert.NotNil(t, err, "Case %d: Condition %s should not parse", i, when)
+	}
+}
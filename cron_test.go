@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallCron(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if !assert.Nil(t, err, "Location should load") {
+		return
+	}
+	start := time.Date(2016, 3, 26, 22, 30, 0, 0, london)
+	cases := []struct {
+		expr string
+		next []time.Time
+	}{
+		{"*/20 * * * *", []time.Time{
+			time.Date(2016, 3, 26, 22, 40, 0, 0, london),
+			time.Date(2016, 3, 26, 23, 0, 0, 0, london),
+		}},
+		{"@daily", []time.Time{
+			time.Date(2016, 3, 27, 0, 0, 0, 0, london),
+			time.Date(2016, 3, 28, 0, 0, 0, 0, london),
+		}},
+		// 1am doesn't exist when the clocks go forward
+		{"30 1 * * *", []time.Time{
+			time.Date(2016, 3, 27, 2, 30, 0, 0, london),
+			time.Date(2016, 3, 28, 1, 30, 0, 0, london),
+		}},
+		{"0 9 * * mon-fri", []time.Time{
+			time.Date(2016, 3, 28, 9, 0, 0, 0, london),
+			time.Date(2016, 3, 29, 9, 0, 0, 0, london),
+		}},
+		// either the day of the month or the day of the week
+		{"0 0 1 * 5", []time.Time{
+			time.Date(2016, 4, 1, 0, 0, 0, 0, london),
+			time.Date(2016, 4, 8, 0, 0, 0, 0, london),
+		}},
+		{"15 6 29 FEB *", []time.Time{
+			time.Date(2020, 2, 29, 6, 15, 0, 0, london),
+			time.Date(2024, 2, 29, 6, 15, 0, 0, london),
+		}},
+	}
+	for _, c := range cases {
+		cron, err := parseCron(c.expr)
+		if !assert.Nil(t, err, "%s should parse", c.expr) {
+			continue
+		}
+		next := start
+		for i, expected := range c.next {
+			next = cron.Next(next)
+			assert.True(t, expected.Equal(next), "%s run %d should be %s not %s", c.expr, i, expected, next)
+		}
+	}
+
+	// 1:30 is repeated when the clocks go back but only runs once
+	nightly, _ := parseCron("30 1 * * *")
+	next := nightly.Next(time.Date(2016, 10, 30, 1, 30, 0, 0, london))
+	assert.Equal(t, time.Date(2016, 10, 31, 1, 30, 0, 0, london).Unix(), next.Unix(), "Repeated time should only run once")
+
+	never, err := parseCron("0 0 30 2 *")
+	assert.Nil(t, err, "Impossible date should parse")
+	assert.True(t, never.Next(start).IsZero(), "Impossible date should never match")
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * * foo *", "5-1 * * * *", "*/0 * * * *"} {
+		_, err := parseCron(expr)
+		assert.NotNil(t, err, "%s should not parse", expr)
+	}
+}
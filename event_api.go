@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// mimeEventStream is the content type of a Server-Sent Events stream
+	mimeEventStream = "text/event-stream"
+	// eventKeepaliveInterval is how often a comment is sent on an
+	// idle Server-Sent Events stream to keep proxies from closing it
+	eventKeepaliveInterval = 30 * time.Second
+)
+
+// EventAPI streams pipeline events
+type EventAPI struct {
+	events EventBroker
+}
+
+// NewEventAPI returns a new EventAPI
+func NewEventAPI(events EventBroker) EventAPI {
+	return EventAPI{
+		events: events,
+	}
+}
+
+// Register adds the routes to the web service container
+func (api EventAPI) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	ws.Path("/events")
+
+	ws.Route(ws.GET("").To(api.streamEvents).
+		Operation("streamEvents").
+		Produces(mimeEventStream).
+		Param(ws.QueryParameter("pipeline_id", "only events for this pipeline").DataType("int")).
+		Param(ws.QueryParameter("after", "resume after this event ID, defaults to the Last-Event-ID header").DataType("int")).
+		Param(ws.HeaderParameter("Last-Event-ID", "resume after this event ID")).
+		Writes(Event{}))
+
+	ws.Route(ws.GET("/ws").To(api.streamEventsWebsocket).
+		Operation("streamEventsWebsocket").
+		Produces(restful.MIME_JSON).
+		Param(ws.QueryParameter("pipeline_id", "only events for this pipeline").DataType("int")).
+		Param(ws.QueryParameter("after", "resume after this event ID").DataType("int")).
+		Writes(Event{}))
+
+	container.Add(ws)
+}
+
+// streamEvents sends events as Server-Sent Events
+func (api EventAPI) streamEvents(request *restful.Request, response *restful.Response) {
+	filter, after, err := parseEventStreamRequest(request)
+	if err != nil {
+		respondStreamError(response, http.StatusBadRequest, err)
+		return
+	}
+	w := response.ResponseWriter
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondStreamError(response, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	subscription := api.events.Subscribe(filter, after)
+	defer subscription.Close()
+
+	response.Header().Set("Content-Type", mimeEventStream)
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				log.Debugf("Failed to send event %d: %s", event.ID, err)
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w io.Writer, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// streamEventsWebsocket sends each event as a JSON WebSocket message
+func (api EventAPI) streamEventsWebsocket(request *restful.Request, response *restful.Response) {
+	filter, after, err := parseEventStreamRequest(request)
+	if err != nil {
+		respondStreamError(response, http.StatusBadRequest, err)
+		return
+	}
+	server := websocket.Server{
+		Handshake: checkWebsocketOrigin,
+		Handler: func(conn *websocket.Conn) {
+			api.sendWebsocketEvents(conn, filter, after)
+		},
+	}
+	server.ServeHTTP(response.ResponseWriter, request.Request)
+}
+
+// checkWebsocketOrigin accepts clients which aren't browsers, which
+// don't send an origin, and pages served by this service, so other
+// sites can't open the event stream with their visitors' access
+func checkWebsocketOrigin(config *websocket.Config, request *http.Request) error {
+	origin, err := websocket.Origin(config, request)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != request.Host {
+		return fmt.Errorf("Origin %s is not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+func (api EventAPI) sendWebsocketEvents(conn *websocket.Conn, filter EventFilter, after *EventID) {
+	defer conn.Close()
+	subscription := api.events.Subscribe(filter, after)
+	defer subscription.Close()
+
+	// clients don't send anything, but reading lets us answer
+	// their pings and notice when they disconnect
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return
+			}
+			if err := websocket.JSON.Send(conn, event); err != nil {
+				log.Debugf("Failed to send event %d: %s", event.ID, err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func parseEventStreamRequest(request *restful.Request) (EventFilter, *EventID, error) {
+	var filter EventFilter
+	if v := request.QueryParameter("pipeline_id"); v != "" {
+		ID, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, nil, fmt.Errorf("pipeline_id must be an int")
+		}
+		pipelineID := PipelineID(ID)
+		filter.PipelineID = &pipelineID
+	}
+	after := request.QueryParameter("after")
+	if after == "" {
+		// sent by browsers when an event source reconnects
+		after = request.HeaderParameter("Last-Event-ID")
+	}
+	if after == "" {
+		return filter, nil, nil
+	}
+	ID, err := strconv.ParseInt(after, 10, 64)
+	if err != nil {
+		return filter, nil, fmt.Errorf("after must be an event ID")
+	}
+	eventID := EventID(ID)
+	return filter, &eventID, nil
+}
+
+// respondStreamError writes a JSON error directly since there
+// is no entity writer for the event stream content type
+func respondStreamError(response *restful.Response, status int, err error) {
+	log.Infof("Error response %d %s", status, err)
+	response.Header().Set("Content-Type", restful.MIME_JSON)
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(errorResponse(err.Error()))
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bbokorney/dockworker"
+)
+
+// EventType is the kind of change an Event describes
+type EventType string
+
+const (
+	// EventPipelineQueued is published when a pipeline is created
+	EventPipelineQueued EventType = "pipeline.queued"
+	// EventPipelineStarted is published when a pipeline starts running
+	EventPipelineStarted EventType = "pipeline.started"
+	// EventPipelineFinished is published when a pipeline reaches a final status
+	EventPipelineFinished EventType = "pipeline.finished"
+	// EventStepStarted is published each time a step starts running
+	EventStepStarted EventType = "step.started"
+	// EventStepRetrying is published when a failed step is going to be run again
+	EventStepRetrying EventType = "step.retrying"
+	// EventStepFinished is published when a step reaches a final status
+	EventStepFinished EventType = "step.finished"
+	// EventJobCreated is published when a job is created for a step
+	EventJobCreated EventType = "job.created"
+)
+
+var eventTypes = []EventType{
+	EventPipelineQueued,
+	EventPipelineStarted,
+	EventPipelineFinished,
+	EventStepStarted,
+	EventStepRetrying,
+	EventStepFinished,
+	EventJobCreated,
+}
+
+// EventID identifies an Event, later events have greater IDs
+type EventID int64
+
+// Event describes a change to a Pipeline or one of its Steps
+type Event struct {
+	ID         EventID          `json:"id"`
+	Type       EventType        `json:"type"`
+	Time       time.Time        `json:"time"`
+	PipelineID PipelineID       `json:"pipeline_id"`
+	Step       string           `json:"step,omitempty"`
+	Status     Status           `json:"status"`
+	JobID      dockworker.JobID `json:"job_id,omitempty"`
+}
+
+// EventFilter selects the events a subscriber receives
+type EventFilter struct {
+	// PipelineID limits the events to one pipeline if set
+	PipelineID *PipelineID
+}
+
+func containsEventType(types []EventType, eventType EventType) bool {
+	for _, t := range types {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (f EventFilter) matches(event Event) bool {
+	return f.PipelineID == nil || *f.PipelineID == event.PipelineID
+}
+
+// EventBroker publishes events to subscribers
+type EventBroker interface {
+	// Publish assigns the event an ID and sends it to the subscribers
+	Publish(event Event) Event
+	// Subscribe returns a subscription to the new events matching the
+	// filter. If after is set the subscription first receives any
+	// retained events after that ID.
+	Subscribe(filter EventFilter, after *EventID) Subscription
+	Close()
+}
+
+// Subscription is a stream of events. The events channel is
+// closed if the subscriber falls too far behind or the broker
+// is closed, after which the subscriber should resubscribe
+// from the ID of the last event it received.
+type Subscription interface {
+	Events() <-chan Event
+	Close()
+}
+
+const subscriptionBufferSize = 100
+
+// NewEventBroker returns a new EventBroker which
+// retains the given number of events for resuming
+func NewEventBroker(history int) EventBroker {
+	return &eventBroker{
+		// IDs start from the current time so that they keep
+		// increasing across restarts, microseconds keep them
+		// small enough to be exact as JavaScript numbers
+		nextID:      EventID(time.Now().UnixNano() / int64(time.Microsecond)),
+		history:     history,
+		subscribers: make(map[*subscription]bool),
+	}
+}
+
+type eventBroker struct {
+	lock        sync.Mutex
+	nextID      EventID
+	history     int
+	events      []Event
+	subscribers map[*subscription]bool
+	closed      bool
+}
+
+func (b *eventBroker) Publish(event Event) Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	event.ID = b.nextID
+	b.nextID++
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if b.closed {
+		return event
+	}
+	if b.history > 0 {
+		if len(b.events) >= b.history {
+			b.events = b.events[1:]
+		}
+		b.events = append(b.events, event)
+	}
+	for s := range b.subscribers {
+		if !s.filter.matches(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			log.Warnf("Dropping event subscriber which has fallen behind at event %d", event.ID)
+			b.remove(s)
+		}
+	}
+	return event
+}
+
+func (b *eventBroker) Subscribe(filter EventFilter, after *EventID) Subscription {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var missed []Event
+	for _, event := range b.events {
+		if after != nil && event.ID > *after && filter.matches(event) {
+			missed = append(missed, event)
+		}
+	}
+	s := &subscription{
+		broker: b,
+		filter: filter,
+		events: make(chan Event, len(missed)+subscriptionBufferSize),
+	}
+	for _, event := range missed {
+		s.events <- event
+	}
+	if b.closed {
+		close(s.events)
+		return s
+	}
+	b.subscribers[s] = true
+	return s
+}
+
+func (b *eventBroker) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for s := range b.subscribers {
+		b.remove(s)
+	}
+}
+
+// remove must be called with the lock held
+func (b *eventBroker) remove(s *subscription) {
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+type subscription struct {
+	broker *eventBroker
+	filter EventFilter
+	events chan Event
+}
+
+func (s *subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *subscription) Close() {
+	s.broker.lock.Lock()
+	defer s.broker.lock.Unlock()
+	s.broker.remove(s)
+}
+
+// pipelineEvents describes the changes between
+// two versions of the same pipeline as events
+func pipelineEvents(old, updated Pipeline) []Event {
+	var events []Event
+	now := time.Now()
+	if old.Status == StatusQueued && updated.Status == StatusRunning {
+		events = append(events, Event{
+			Type:       EventPipelineStarted,
+			Time:       now,
+			PipelineID: updated.ID,
+			Status:     updated.Status,
+		})
+	}
+	for i, step := range updated.Steps {
+		var oldStep Step
+		if i < len(old.Steps) {
+			oldStep = *old.Steps[i]
+		}
+		stepEvent := func(eventType EventType) Event {
+			return Event{
+				Type:       eventType,
+				Time:       now,
+				PipelineID: updated.ID,
+				Step:       step.Name,
+				Status:     step.Status,
+				JobID:      step.JobID,
+			}
+		}
+		if step.JobID != 0 && step.JobID != oldStep.JobID {
+			events = append(events, stepEvent(EventJobCreated))
+		}
+		switch {
+		case stepFinished(*step) && !stepFinished(oldStep):
+			// checked first, a stopped step keeps its status
+			// when the final update for its job is received
+			events = append(events, stepEvent(EventStepFinished))
+		case step.Status == oldStep.Status:
+		case stepRunning(*step):
+			events = append(events, stepEvent(EventStepStarted))
+		case step.Status == StatusRetrying:
+			events = append(events, stepEvent(EventStepRetrying))
+		}
+	}
+	if !pipelineDone(old) && pipelineDone(updated) {
+		events = append(events, Event{
+			Type:       EventPipelineFinished,
+			Time:       now,
+			PipelineID: updated.ID,
+			Status:     updated.Status,
+		})
+	}
+	return events
+}
+
+// stepFinished checks if a step will not run again and has
+// received the final update for its job, a step being stopped
+// or timed out is given its status before the update comes
+func stepFinished(step Step) bool {
+	if stepAwaitingJob(step) {
+		return false
+	}
+	return stepDone(step) || step.Status == StatusNotRun || step.Status == StatusStopped
+}
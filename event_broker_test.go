@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestSmallEventBroker(t *testing.T) {
+	broker := NewEventBroker(3)
+	all := broker.Subscribe(EventFilter{}, nil)
+	pipelineID := PipelineID(2)
+	filtered := broker.Subscribe(EventFilter{PipelineID: &pipelineID}, nil)
+
+	for i := 1; i <= 4; i++ {
+		broker.Publish(Event{Type: EventPipelineQueued, PipelineID: PipelineID(i)})
+	}
+	var published []Event
+	for i := 0; i < 4; i++ {
+		published = append(published, <-all.Events())
+	}
+	for i := 1; i < len(published); i++ {
+		assert.Equal(t, published[i-1].ID+1, published[i].ID, "Event IDs should increase")
+	}
+	assert.Equal(t, PipelineID(2), (<-filtered.Events()).PipelineID, "Filtered events should be for the pipeline")
+	assert.Equal(t, 0, len(filtered.Events()), "Other pipelines' events should be filtered out")
+
+	// resuming only replays the retained events after the ID
+	resumed := broker.Subscribe(EventFilter{}, &published[0].ID)
+	assert.Equal(t, 3, len(resumed.Events()), "Retained events should be replayed")
+	assert.Equal(t, published[1], <-resumed.Events(), "Replay should start after the ID")
+	resumed.Close()
+	remaining := 0
+	for range resumed.Events() {
+		remaining++
+	}
+	assert.Equal(t, 2, remaining, "Closed subscription should end after its buffered events")
+
+	broker.Close()
+	_, open := <-all.Events()
+	assert.False(t, open, "Subscriptions should be closed with the broker")
+}
+
+func TestSmallPipelineEvents(t *testing.T) {
+	old := Pipeline{
+		ID:     1,
+		Status: StatusQueued,
+		Steps: []*Step{
+			&Step{Name: "build", Status: StatusQueued},
+			&Step{Name: "test", Status: StatusQueued},
+		},
+	}
+	running := copySteps(old)
+	running.Status = StatusRunning
+	running.Steps[0].Status = StatusRunning
+	running.Steps[0].JobID = 7
+
+	events := pipelineEvents(old, running)
+	var types []EventType
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []EventType{EventPipelineStarted, EventJobCreated, EventStepStarted}, types, "Start events should match")
+
+	finished := copySteps(running)
+	finished.Status = StatusFailed
+	finished.Steps[0].Status = StatusFailed
+	finished.Steps[1].Status = StatusNotRun
+	events = pipelineEvents(running, finished)
+	types = nil
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []EventType{EventStepFinished, EventStepFinished, EventPipelineFinished}, types, "Finish events should match")
+	assert.Equal(t, "build", events[0].Step, "Step name should be set")
+	assert.Equal(t, StatusFailed, events[2].Status, "Pipeline status should be set")
+
+	// a timed out step finishes once its stopped job does
+	stopping := copySteps(running)
+	stopping.Status = StatusStopping
+	stopping.Steps[0].Status = StatusTimedOut
+	stopping.Steps[0].EndTime = NotRunTime
+	assert.Empty(t, pipelineEvents(running, stopping), "Step waiting for its job should not finish")
+	stopped := copySteps(stopping)
+	stopped.Status = StatusFailed
+	stopped.Steps[0].EndTime = time.Now()
+	stopped.Steps[1].Status = StatusNotRun
+	events = pipelineEvents(stopping, stopped)
+	if assert.Equal(t, 3, len(events), "Finish events should be sent") {
+		assert.Equal(t, EventStepFinished, events[0].Type, "Timed out step should finish")
+		assert.Equal(t, StatusTimedOut, events[0].Status, "Step status should be set")
+	}
+}
+
+func TestSmallEventAPI(t *testing.T) {
+	broker := NewEventBroker(10)
+	broker.Publish(Event{Type: EventPipelineQueued, PipelineID: 1})
+	container := restful.NewContainer()
+	NewEventAPI(broker).Register(container)
+	server := httptest.NewServer(container)
+	defer server.Close()
+
+	// Server-Sent Events resuming from before the first event
+	sse, err := http.Get(server.URL + "/events?after=0")
+	if !assert.Nil(t, err, "Request should succeed") {
+		return
+	}
+	defer sse.Body.Close()
+	assert.Equal(t, mimeEventStream, sse.Header.Get("Content-Type"), "Content type should be an event stream")
+	reader := bufio.NewReader(sse.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if !assert.Nil(t, err, "Event should be read") {
+			return
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	assert.True(t, strings.HasPrefix(lines[0], "id: "), "Event should have an ID")
+	assert.Equal(t, "event: pipeline.queued", lines[1], "Event type should match")
+	assert.Contains(t, lines[2], `"pipeline_id":1`, "Event data should match")
+
+	// WebSocket for a single pipeline
+	broker.Publish(Event{Type: EventPipelineStarted, PipelineID: 2})
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/events/ws?after=0&pipeline_id=2"
+	conn, err := websocket.Dial(wsURL, "", server.URL)
+	if !assert.Nil(t, err, "WebSocket should connect") {
+		return
+	}
+	defer conn.Close()
+	var event Event
+	assert.Nil(t, websocket.JSON.Receive(conn, &event), "Event should be received")
+	assert.Equal(t, EventPipelineStarted, event.Type, "Only the pipeline's events should be sent")
+
+	_, err = websocket.Dial(wsURL, "", "http://example.com")
+	assert.NotNil(t, err, "WebSocket from another site should be rejected")
+
+	resp, err := http.Get(server.URL + "/events/ws")
+	if assert.Nil(t, err, "Request should succeed") {
+		assert.Equal(t, 400, resp.StatusCode, "Request which isn't an upgrade should be rejected")
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(server.URL + "/events?pipeline_id=x")
+	if assert.Nil(t, err, "Request should succeed") {
+		assert.Equal(t, 400, resp.StatusCode, "Invalid pipeline ID should be rejected")
+		resp.Body.Close()
+	}
+}
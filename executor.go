@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/bbokorney/dockworker"
+	"github.com/bbokorney/dockworker/client"
+)
+
+const (
+	// RunnerDockworker runs a step's commands in a container using dockworker
+	RunnerDockworker = "dockworker"
+	// RunnerLocal runs a step's commands directly on the host
+	RunnerLocal = "local"
+)
+
+// Executor runs the jobs for steps. Updates to the state of a job
+// are sent to the webhook URL of the job or its webhook channel.
+type Executor interface {
+	CreateJob(job dockworker.Job) (dockworker.Job, error)
+	GetJob(ID dockworker.JobID) (dockworker.Job, error)
+	StopJob(ID dockworker.JobID) error
+	// JobURL is where the details of a job can be found
+	JobURL(ID dockworker.JobID) string
+}
+
+// ExecutorRegistry holds the executors a step can choose with its runner
+type ExecutorRegistry interface {
+	Register(runner string, executor Executor)
+	Get(runner string) (Executor, bool)
+	// DefaultRunner is used for steps which don't set a runner
+	DefaultRunner() string
+}
+
+// NewExecutorRegistry returns a new ExecutorRegistry
+func NewExecutorRegistry(defaultRunner string) ExecutorRegistry {
+	return &executorRegistry{
+		executors:     make(map[string]Executor),
+		defaultRunner: defaultRunner,
+		lock:          &sync.RWMutex{},
+	}
+}
+
+type executorRegistry struct {
+	executors     map[string]Executor
+	defaultRunner string
+	lock          *sync.RWMutex
+}
+
+func (r *executorRegistry) Register(runner string, executor Executor) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.executors[runner] = executor
+}
+
+func (r *executorRegistry) Get(runner string) (Executor, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	executor, ok := r.executors[runner]
+	return executor, ok
+}
+
+func (r *executorRegistry) DefaultRunner() string {
+	return r.defaultRunner
+}
+
+// NewDockworkerExecutor returns an Executor which runs jobs with dockworker
+func NewDockworkerExecutor(dwClient client.Client) Executor {
+	return dockworkerExecutor{
+		dwClient: dwClient,
+	}
+}
+
+type dockworkerExecutor struct {
+	dwClient client.Client
+}
+
+func (e dockworkerExecutor) CreateJob(job dockworker.Job) (dockworker.Job, error) {
+	return e.dwClient.CreateJob(job)
+}
+
+func (e dockworkerExecutor) GetJob(ID dockworker.JobID) (dockworker.Job, error) {
+	return e.dwClient.GetJob(ID)
+}
+
+func (e dockworkerExecutor) StopJob(ID dockworker.JobID) error {
+	return e.dwClient.StopJob(ID)
+}
+
+func (e dockworkerExecutor) JobURL(ID dockworker.JobID) string {
+	return fmt.Sprintf("%s/jobs/%d", e.dwClient.BaseURL(), ID)
+}
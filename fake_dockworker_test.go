@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bbokorney/dockworker"
+)
+
+// fakeStepScript changes how the fake dockworker runs the jobs of a step
+type fakeStepScript struct {
+	// Status is the status the job finishes with, by default
+	// it is worked out from the commands of the job
+	Status dockworker.JobStatus
+	// Attempts are the statuses the step's successive jobs finish
+	// with instead of Status, the last is used for any more jobs
+	Attempts []dockworker.JobStatus
+	// Duration is how long the job runs for, by default it is
+	// the total of the job's sleep commands
+	Duration time.Duration
+	// CreateErr is returned instead of creating the job
+	CreateErr error
+	// WebhookDelay delays the job's webhooks
+	WebhookDelay time.Duration
+	// DropWebhooks loses the job's webhooks, so
+	// the job's updates are only found by polling
+	DropWebhooks bool
+}
+
+// fakeDockworker is an in-memory Executor which pretends to run
+// jobs. Commands succeed immediately apart from "sleep N", which
+// takes N seconds multiplied by the time scale, and commands set
+// to fail with failCmd. Webhooks are passed to the webhook func.
+type fakeDockworker struct {
+	timeScale float64
+	webhook   func(job dockworker.Job)
+	lock      *sync.Mutex
+	nextID    dockworker.JobID
+	jobs      map[dockworker.JobID]*fakeJob
+	scripts   map[string]fakeStepScript
+	failing   map[string]bool
+	// created counts the jobs created for each step
+	created map[string]int
+	// getJobFailures is the number of GetJob calls left to fail
+	getJobFailures int
+}
+
+type fakeJob struct {
+	dockworker.Job
+	script fakeStepScript
+	stop   chan struct{}
+}
+
+// newFakeDockworker returns a fakeDockworker which sends
+// its webhooks to webhookChan, as the webhook API would
+func newFakeDockworker(webhookChan chan dockworker.Job, timeScale float64) *fakeDockworker {
+	d := &fakeDockworker{
+		timeScale: timeScale,
+		lock:      &sync.Mutex{},
+		nextID:    1,
+		jobs:      make(map[dockworker.JobID]*fakeJob),
+		scripts:   make(map[string]fakeStepScript),
+		failing:   make(map[string]bool),
+		created:   make(map[string]int),
+	}
+	d.sendWebhooksTo(webhookChan)
+	return d
+}
+
+// sendWebhooksTo sends the webhooks of the jobs to webhookChan
+// from now on, as if the service had been restarted
+func (d *fakeDockworker) sendWebhooksTo(webhookChan chan dockworker.Job) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.webhook = func(job dockworker.Job) {
+		webhookChan <- job
+	}
+}
+
+// failGetJob makes the next n calls to GetJob fail
+func (d *fakeDockworker) failGetJob(n int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.getJobFailures = n
+}
+
+// script sets how the jobs of the step with the given name are run
+func (d *fakeDockworker) script(step string, script fakeStepScript) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.scripts[step] = script
+}
+
+// resetCreated starts counting the jobs of the step again
+func (d *fakeDockworker) resetCreated(step string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.created[step] = 0
+}
+
+// failCmd makes the command fail when it is run
+func (d *fakeDockworker) failCmd(cmd string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.failing[cmd] = true
+}
+
+func (d *fakeDockworker) CreateJob(job dockworker.Job) (dockworker.Job, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	step := webhookStep(job.WebhookURL)
+	script := d.scripts[step]
+	if script.CreateErr != nil {
+		return dockworker.Job{}, script.CreateErr
+	}
+	if len(script.Attempts) > 0 {
+		attempt := d.created[step]
+		if attempt >= len(script.Attempts) {
+			attempt = len(script.Attempts) - 1
+		}
+		script.Status = script.Attempts[attempt]
+	}
+	d.created[step]++
+	if script.Status == "" || script.Duration == 0 {
+		status, duration := d.simulate(job.Cmds)
+		if script.Status == "" {
+			script.Status = status
+		}
+		if script.Duration == 0 {
+			script.Duration = duration
+		}
+	}
+	job.ID = d.nextID
+	d.nextID++
+	job.Status = dockworker.JobStatusRunning
+	job.StartTime = time.Now()
+	j := &fakeJob{Job: job, script: script, stop: make(chan struct{})}
+	d.jobs[job.ID] = j
+	go d.run(j)
+	return job, nil
+}
+
+// simulate works out how the commands would finish
+func (d *fakeDockworker) simulate(cmds []dockworker.Cmd) (dockworker.JobStatus, time.Duration) {
+	var duration time.Duration
+	for _, cmd := range cmds {
+		if d.failing[strings.Join(cmd, " ")] {
+			return dockworker.JobStatusFailed, duration
+		}
+		if len(cmd) == 2 && cmd[0] == "sleep" {
+			seconds, err := strconv.ParseFloat(cmd[1], 64)
+			if err == nil {
+				duration += time.Duration(seconds * d.timeScale * float64(time.Second))
+			}
+		}
+	}
+	return dockworker.JobStatusSuccessful, duration
+}
+
+func (d *fakeDockworker) run(j *fakeJob) {
+	d.sendWebhook(j.Job, j.script)
+	status := j.script.Status
+	select {
+	case <-time.After(j.script.Duration):
+	case <-j.stop:
+		status = dockworker.JobStatusStopped
+	}
+	d.lock.Lock()
+	if !jobDone(j.Job) {
+		j.Status = status
+		j.EndTime = time.Now()
+	}
+	job := j.Job
+	d.lock.Unlock()
+	d.sendWebhook(job, j.script)
+}
+
+func (d *fakeDockworker) sendWebhook(job dockworker.Job, script fakeStepScript) {
+	if script.DropWebhooks {
+		return
+	}
+	if script.WebhookDelay == 0 {
+		d.currentWebhook()(job)
+		return
+	}
+	go func() {
+		time.Sleep(script.WebhookDelay)
+		d.currentWebhook()(job)
+	}()
+}
+
+func (d *fakeDockworker) currentWebhook() func(job dockworker.Job) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.webhook
+}
+
+func (d *fakeDockworker) GetJob(ID dockworker.JobID) (dockworker.Job, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.getJobFailures > 0 {
+		d.getJobFailures--
+		return dockworker.Job{}, fmt.Errorf("Dockworker is down")
+	}
+	j, ok := d.jobs[ID]
+	if !ok {
+		return dockworker.Job{}, fmt.Errorf("Job %d not found", ID)
+	}
+	return j.Job, nil
+}
+
+func (d *fakeDockworker) StopJob(ID dockworker.JobID) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	j, ok := d.jobs[ID]
+	if !ok {
+		return fmt.Errorf("Job %d not found", ID)
+	}
+	if !jobDone(j.Job) {
+		select {
+		case <-j.stop:
+		default:
+			close(j.stop)
+		}
+	}
+	return nil
+}
+
+func (d *fakeDockworker) JobURL(ID dockworker.JobID) string {
+	return fmt.Sprintf("http://dockworker/jobs/%d", ID)
+}
+
+// webhookStep returns the step name from a job's webhook URL
+func webhookStep(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("step")
+}
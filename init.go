@@ -1,6 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/bbokorney/dockworker"
 	"github.com/bbokorney/dockworker/client"
@@ -15,32 +23,232 @@ type Config struct {
 	BindAddress   string `default:"0.0.0.0"`
 	BindPort      int    `default:"4322"`
 	WebhookURL    string `default:"http://pipeline:4322/webhook"`
+	// WebhookSecret signs the webhook URLs given to dockworker, it
+	// must be set for the file store, otherwise a random one is used
+	WebhookSecret string
+	StoreType     string        `default:"memory"`
+	StoreDir      string        `default:"/var/lib/pipeline"`
+	DrainMode     string        `default:"wait"`
+	DrainTimeout  time.Duration `default:"5m"`
+	EventHistory  int           `default:"1000"`
+	// PollInterval is how often running jobs are checked in
+	// case their webhooks are lost, 0 disables polling
+	PollInterval time.Duration `default:"30s"`
+	// NotificationSecret signs notifications if set
+	NotificationSecret      string
+	NotificationMaxAttempts int           `default:"5"`
+	NotificationBackoff     time.Duration `default:"1s"`
+	NotificationMaxBackoff  time.Duration `default:"1m"`
+	// NotificationDeadLetterFile records undeliverable notifications if set
+	NotificationDeadLetterFile string
+	// DefaultRunner is used for steps which don't set a runner
+	DefaultRunner string `default:"dockworker"`
+	// LocalRunner enables the local runner, which runs
+	// commands directly on the host without a container
+	LocalRunner bool
+	// LocalJobURL is where the details of local jobs are served
+	LocalJobURL string `default:"http://pipeline:4322/local/jobs"`
+	// MaxRunningPipelines, MaxStepsPerPipeline and MaxRunningJobs
+	// limit how much runs at once, 0 means no limit
+	MaxRunningPipelines int
+	MaxStepsPerPipeline int
+	MaxRunningJobs      int
+	// QueueWeights gives queues a bigger share of the pipelines
+	// started, such as "release:4,nightly:1", the default is 1
+	QueueWeights string
 }
 
+const (
+	// StoreTypeMemory keeps pipelines in memory only
+	StoreTypeMemory = "memory"
+	// StoreTypeFile persists pipelines to StoreDir
+	StoreTypeFile = "file"
+)
+
 var config Config
 
-func doInit() *restful.Container {
+// app holds the parts of the service which
+// need to be shut down when the program exits
+type app struct {
+	container       *restful.Container
+	manager         Manager
+	webhookListener WebhookListener
+	pipelineStore   PipelineStore
+	events          EventBroker
+	notifier        Notifier
+	schedules       ScheduleService
+	// localExecutor is nil if the local runner isn't enabled
+	localExecutor LocalExecutor
+}
+
+func doInit() app {
 	if err := envconfig.Process("pipeline", &config); err != nil {
 		log.Fatalf("Failed to read config: %s", err)
 	}
 	// TODO: logging level from config
 	log.SetLevel(log.DebugLevel)
+	webhookChan := make(chan dockworker.Job)
+	executors := NewExecutorRegistry(config.DefaultRunner)
+	executors.Register(RunnerDockworker, NewDockworkerExecutor(client.NewClient(config.DockworkerURL)))
+	return newApp(webhookChan, executors)
+}
+
+// newApp wires up the service using the executors given. Job
+// updates sent to webhookChan are handled as received webhooks.
+func newApp(webhookChan chan dockworker.Job, executors ExecutorRegistry) app {
 	wsContainer := restful.NewContainer()
 	wsContainer.Filter(globalLogging)
-	dwClient := client.NewClient(config.DockworkerURL)
-	webhookChan := make(chan dockworker.Job)
-	webhookListener := NewWebhookListener(webhookChan, config.WebhookURL)
+	webhookAuth := newConfiguredWebhookAuth()
+	webhookListener := NewWebhookListener(webhookChan, config.WebhookURL, webhookAuth)
 	webhookListener.Start()
-	pipelineStore := NewPipelineStore()
-	updater := NewUpdater(pipelineStore)
-	manager := NewManager(dwClient, updater, webhookListener)
+	pipelineStore, err := newConfiguredPipelineStore()
+	if err != nil {
+		log.Fatalf("Failed to create pipeline store: %s", err)
+	}
+	events := NewEventBroker(config.EventHistory)
+	notifier := NewNotifier(config.NotificationSecret, RetryPolicy{
+		MaxAttempts: config.NotificationMaxAttempts,
+		Backoff:     Duration(config.NotificationBackoff),
+		MaxBackoff:  Duration(config.NotificationMaxBackoff),
+	}, config.NotificationDeadLetterFile)
+	updater := NewUpdater(pipelineStore, events, notifier)
+	queueWeights, err := parseQueueWeights(config.QueueWeights)
+	if err != nil {
+		log.Fatalf("Failed to read queue weights: %s", err)
+	}
+	if config.DrainMode != DrainModeWait && config.DrainMode != DrainModeStop {
+		log.Fatalf("Unknown drain mode %s", config.DrainMode)
+	}
+	var localExecutor LocalExecutor
+	if config.LocalRunner {
+		localExecutor = NewLocalExecutor(webhookChan, config.LocalJobURL)
+		executors.Register(RunnerLocal, localExecutor)
+		NewLocalJobAPI(localExecutor).Register(wsContainer)
+	}
+	manager := NewManager(executors, updater, webhookListener, pipelineStore, config.PollInterval, Limits{
+		Pipelines:        config.MaxRunningPipelines,
+		StepsPerPipeline: config.MaxStepsPerPipeline,
+		Jobs:             config.MaxRunningJobs,
+	}, queueWeights)
 	manager.Start()
-	pipelineService := NewPipelineService(pipelineStore, manager)
+	pipelineService := NewPipelineService(pipelineStore, manager, updater, executors)
+	scheduleStore, err := newConfiguredScheduleStore()
+	if err != nil {
+		log.Fatalf("Failed to create schedule store: %s", err)
+	}
+	scheduleService := NewScheduleService(scheduleStore, pipelineService)
+	scheduleService.Start()
+	templateStore, err := newConfiguredTemplateStore()
+	if err != nil {
+		log.Fatalf("Failed to create template store: %s", err)
+	}
+	templateService := NewTemplateService(templateStore, pipelineService)
 	pipelineAPI := NewPipelineAPI(pipelineService)
-	webhookAPI := NewWebhookAPI(webhookChan)
+	webhookAPI := NewWebhookAPI(webhookListener, webhookAuth)
+	eventAPI := NewEventAPI(events)
 	pipelineAPI.Register(wsContainer)
 	webhookAPI.Register(wsContainer)
-	return wsContainer
+	eventAPI.Register(wsContainer)
+	NewScheduleAPI(scheduleService).Register(wsContainer)
+	NewTemplateAPI(templateService).Register(wsContainer)
+	// expvar publishes the metrics on the default mux
+	wsContainer.Handle("/debug/vars", http.DefaultServeMux)
+	return app{
+		container:       wsContainer,
+		manager:         manager,
+		webhookListener: webhookListener,
+		pipelineStore:   pipelineStore,
+		events:          events,
+		notifier:        notifier,
+		schedules:       scheduleService,
+		localExecutor:   localExecutor,
+	}
+}
+
+// shutdown drains the running pipelines and releases resources.
+// The server is only shut down once draining is done so that
+// webhooks for the draining pipelines are still received, then
+// it is given the drain timeout to finish the requests in flight.
+func (a app) shutdown(server *http.Server) {
+	a.schedules.Stop()
+	a.manager.Stop(config.DrainMode, config.DrainTimeout)
+	// end the event streams once the last events are published
+	a.events.Close()
+	a.notifier.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Failed to shut down server: %s", err)
+	}
+	a.webhookListener.Stop()
+	if a.localExecutor != nil {
+		a.localExecutor.Stop()
+	}
+	if err := a.pipelineStore.Close(); err != nil {
+		log.Errorf("Failed to close pipeline store: %s", err)
+	}
+}
+
+func newConfiguredPipelineStore() (PipelineStore, error) {
+	switch config.StoreType {
+	case StoreTypeMemory:
+		return NewPipelineStore(), nil
+	case StoreTypeFile:
+		return NewFilePipelineStore(config.StoreDir)
+	default:
+		return nil, fmt.Errorf("Unknown store type %s", config.StoreType)
+	}
+}
+
+func newConfiguredScheduleStore() (ScheduleStore, error) {
+	if config.StoreType == StoreTypeFile {
+		return NewFileScheduleStore(filepath.Join(config.StoreDir, "schedules.json"))
+	}
+	return NewScheduleStore(), nil
+}
+
+func newConfiguredTemplateStore() (TemplateStore, error) {
+	if config.StoreType == StoreTypeFile {
+		return NewFileTemplateStore(filepath.Join(config.StoreDir, "templates.json"))
+	}
+	return NewTemplateStore(), nil
+}
+
+func newConfiguredWebhookAuth() webhookAuth {
+	if config.WebhookSecret != "" {
+		return newWebhookAuth(config.WebhookSecret)
+	}
+	// pipelines are only resumed after a restart with the
+	// file store, their jobs' webhooks need the same secret
+	if config.StoreType == StoreTypeFile {
+		log.Fatal("A webhook secret must be set to use the file store")
+	}
+	log.Warn("No webhook secret set, using a random one")
+	secret, err := randomWebhookSecret()
+	if err != nil {
+		log.Fatalf("Failed to generate webhook secret: %s", err)
+	}
+	return newWebhookAuth(secret)
+}
+
+// parseQueueWeights parses a list of queue:weight pairs
+func parseQueueWeights(s string) (map[string]int, error) {
+	weights := make(map[string]int)
+	if s == "" {
+		return weights, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Queue weight %q must be queue:weight", pair)
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("Weight of queue %s must be a positive int", parts[0])
+		}
+		weights[strings.TrimSpace(parts[0])] = weight
+	}
+	return weights, nil
 }
 
 func globalLogging(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+)
+
+// Limits restricts how much work runs at once, 0 means no limit
+type Limits struct {
+	// Pipelines is the number of pipelines run at once,
+	// the rest wait in the queued status
+	Pipelines int
+	// StepsPerPipeline is the number of jobs each pipeline runs at once
+	StepsPerPipeline int
+	// Jobs is the number of jobs run at once across all pipelines
+	Jobs int
+}
+
+// JobLimiter shares out a limited number of job slots between
+// pipelines. Pipelines which can't get a slot wait and are given
+// slots in the order a Scheduler would start them, by highest
+// priority and then fairly between their queues.
+type JobLimiter interface {
+	// Acquire takes a slot for a job of the pipeline. If none are
+	// free the pipeline is queued and false is returned, ready is
+	// sent to once a slot has been reserved for the pipeline.
+	Acquire(pipeline Pipeline, ready chan<- struct{}) bool
+	// Hold takes a slot for a job which is already running, even
+	// if that goes over the limit, such as when resuming a pipeline
+	Hold(ID PipelineID)
+	// Release frees the slot of a finished job
+	Release(ID PipelineID)
+	// Withdraw removes the pipeline from the queue, freeing any
+	// slots reserved for it which it no longer needs
+	Withdraw(ID PipelineID)
+	// Positions are the places of the waiting pipelines
+	// in the queue, starting from 1
+	Positions() map[PipelineID]int
+}
+
+// NewJobLimiter returns a JobLimiter with max slots, or which never
+// makes pipelines wait if max is 0. The queues of the pipelines
+// waiting for slots share them according to queueWeights, the
+// same as the queues of the pipelines waiting to start.
+func NewJobLimiter(max int, queueWeights map[string]int) JobLimiter {
+	return &jobLimiter{
+		max:      max,
+		waiting:  NewScheduler(queueWeights),
+		ready:    make(map[PipelineID]chan<- struct{}),
+		reserved: make(map[PipelineID]int),
+		lock:     &sync.Mutex{},
+	}
+}
+
+type jobLimiter struct {
+	max     int
+	running int
+	// waiting orders the pipelines waiting for a slot, ready
+	// is sent to when a slot is reserved for one of them
+	waiting  Scheduler
+	ready    map[PipelineID]chan<- struct{}
+	reserved map[PipelineID]int
+	lock     *sync.Mutex
+}
+
+func (l *jobLimiter) Acquire(pipeline Pipeline, ready chan<- struct{}) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ID := pipeline.ID
+	if l.reserved[ID] > 0 {
+		// the slot was counted when it was reserved
+		l.reserved[ID]--
+		if l.reserved[ID] == 0 {
+			delete(l.reserved, ID)
+		}
+		return true
+	}
+	if l.max == 0 || (l.running < l.max && l.waiting.Len() == 0) {
+		l.running++
+		return true
+	}
+	if _, waiting := l.ready[ID]; waiting {
+		return false
+	}
+	// only keep what the pipeline is scheduled by
+	l.waiting.Push(Pipeline{ID: ID, Priority: pipeline.Priority, Queue: pipeline.Queue})
+	l.ready[ID] = ready
+	return false
+}
+
+func (l *jobLimiter) Hold(ID PipelineID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running++
+}
+
+func (l *jobLimiter) Release(ID PipelineID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.running--
+	l.grant()
+}
+
+func (l *jobLimiter) Withdraw(ID PipelineID) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.waiting.Remove(ID) {
+		delete(l.ready, ID)
+	}
+	if reserved := l.reserved[ID]; reserved > 0 {
+		l.running -= reserved
+		delete(l.reserved, ID)
+		l.grant()
+	}
+}
+
+func (l *jobLimiter) Positions() map[PipelineID]int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.waiting.Positions()
+}
+
+// grant reserves the free slots for the next pipelines to be scheduled
+func (l *jobLimiter) grant() {
+	for l.waiting.Len() > 0 && (l.max == 0 || l.running < l.max) {
+		p, _ := l.waiting.Pop()
+		ready := l.ready[p.ID]
+		delete(l.ready, p.ID)
+		l.running++
+		l.reserved[p.ID]++
+		select {
+		case ready <- struct{}{}:
+		default:
+			// the pipeline already has a reservation to look at
+		}
+	}
+}
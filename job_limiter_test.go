@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallJobLimiter(t *testing.T) {
+	limiter := NewJobLimiter(2, nil)
+	ready1, ready2 := make(chan struct{}, 1), make(chan struct{}, 1)
+
+	assert.True(t, limiter.Acquire(Pipeline{ID: 1}, ready1), "First slot should be free")
+	assert.True(t, limiter.Acquire(Pipeline{ID: 1}, ready1), "Second slot should be free")
+	assert.False(t, limiter.Acquire(Pipeline{ID: 2}, ready2), "No slots should be left")
+	assert.False(t, limiter.Acquire(Pipeline{ID: 1}, ready1), "No slots should be left")
+	assert.Equal(t, 1, limiter.Positions()[2], "First waiter should be at the front")
+	assert.Equal(t, 2, limiter.Positions()[1], "Second waiter should be behind")
+
+	// freed slots are reserved in queue order
+	limiter.Release(1)
+	assert.Equal(t, 1, len(ready2), "First waiter should be told of its slot")
+	assert.Equal(t, 0, len(ready1), "Second waiter should still wait")
+	assert.False(t, limiter.Acquire(Pipeline{ID: 3}, nil), "Reserved slot should not be taken by others")
+	assert.True(t, limiter.Acquire(Pipeline{ID: 2}, ready2), "Reserved slot should be taken")
+
+	// withdrawing hands a reserved slot to the next waiter
+	limiter.Release(1)
+	assert.Equal(t, 1, len(ready1), "Waiter should be told of its slot")
+	limiter.Withdraw(1)
+	assert.Equal(t, 0, limiter.Positions()[3], "Withdrawn slot should go to the next waiter")
+	assert.True(t, limiter.Acquire(Pipeline{ID: 3}, nil), "Reserved slot should be taken")
+
+	unlimited := NewJobLimiter(0, nil)
+	for i := 0; i < 10; i++ {
+		assert.True(t, unlimited.Acquire(Pipeline{ID: 1}, nil), "Unlimited slots should always be free")
+	}
+}
+
+func TestSmallJobLimiterQueues(t *testing.T) {
+	// queue a gets two slots for each of queue b's
+	limiter := NewJobLimiter(1, map[string]int{"a": 2})
+	assert.True(t, limiter.Acquire(Pipeline{ID: 100}, nil), "First slot should be free")
+
+	ready := make(map[PipelineID]chan struct{})
+	waiters := []Pipeline{
+		{ID: 1, Queue: "a"}, {ID: 2, Queue: "a"}, {ID: 3, Queue: "a"}, {ID: 4, Queue: "a"},
+		{ID: 5, Queue: "b"}, {ID: 6, Queue: "b"},
+	}
+	for _, p := range waiters {
+		ready[p.ID] = make(chan struct{}, 1)
+		assert.False(t, limiter.Acquire(p, ready[p.ID]), "Pipeline %d should wait", p.ID)
+	}
+	assert.Equal(t, 2, limiter.Positions()[5], "Queue b should not wait for all of queue a")
+
+	var order []PipelineID
+	holder := PipelineID(100)
+	for range waiters {
+		limiter.Release(holder)
+		for ID, c := range ready {
+			if len(c) > 0 {
+				<-c
+				order = append(order, ID)
+				assert.True(t, limiter.Acquire(Pipeline{ID: ID}, nil), "Reserved slot should be taken")
+				holder = ID
+			}
+		}
+	}
+	assert.Equal(t, []PipelineID{1, 5, 2, 3, 6, 4}, order, "Slots should be shared between the queues by weight")
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bbokorney/dockworker"
+)
+
+const (
+	// maxLocalJobOutput is how much of the end of a local job's output is kept
+	maxLocalJobOutput = 1 << 20
+	// localJobRetention is the number of finished local jobs kept
+	localJobRetention = 1000
+	// localJobWaitDelay is how long the output of a command is read
+	// after it exits, in case something it started still holds it
+	localJobWaitDelay = 5 * time.Second
+)
+
+// localJobEnv are the variables of the service's environment passed
+// on to local jobs. The rest, such as the secrets in its config,
+// aren't for the jobs to see.
+var localJobEnv = []string{"PATH", "HOME", "USER", "LANG"}
+
+var (
+	// ErrLocalJobNotFound indicates the local job doesn't exist,
+	// local jobs don't survive a restart of the service
+	ErrLocalJobNotFound = errors.New("Local job not found")
+)
+
+// LocalJob is a job run by the local executor
+type LocalJob struct {
+	dockworker.Job
+	// ExitCode is the exit code of the last command run
+	ExitCode int `json:"exit_code"`
+	// Output is the combined stdout and stderr of the commands
+	Output string `json:"output"`
+}
+
+// LocalExecutor is an Executor which runs the commands
+// of a job as processes on the host, one after another
+type LocalExecutor interface {
+	Executor
+	FindJob(ID dockworker.JobID) (LocalJob, error)
+	// Stop stops sending updates, for when nothing receives them
+	Stop()
+}
+
+// NewLocalExecutor returns a new LocalExecutor which sends the
+// updates for its jobs to webhookChan. Job details are served
+// under jobURL.
+func NewLocalExecutor(webhookChan chan dockworker.Job, jobURL string) LocalExecutor {
+	return &localExecutor{
+		webhookChan: webhookChan,
+		jobURL:      jobURL,
+		// local job IDs are negative so they can't clash with
+		// dockworker's, and start from the current time so
+		// they aren't reused after a restart
+		nextID:   -dockworker.JobID(time.Now().UnixNano() / int64(time.Microsecond)),
+		jobs:     make(map[dockworker.JobID]*localJob),
+		stopChan: make(chan struct{}),
+		lock:     &sync.Mutex{},
+	}
+}
+
+type localExecutor struct {
+	webhookChan chan dockworker.Job
+	jobURL      string
+	nextID      dockworker.JobID
+	jobs        map[dockworker.JobID]*localJob
+	finished    []dockworker.JobID
+	stopChan    chan struct{}
+	stopOnce    sync.Once
+	lock        *sync.Mutex
+}
+
+type localJob struct {
+	LocalJob
+	output  *tailBuffer
+	process *os.Process
+	stopped bool
+}
+
+func (e *localExecutor) CreateJob(job dockworker.Job) (dockworker.Job, error) {
+	dir, err := ioutil.TempDir("", "pipeline-job")
+	if err != nil {
+		return dockworker.Job{}, err
+	}
+	e.lock.Lock()
+	job.ID = e.nextID
+	e.nextID--
+	job.Status = dockworker.JobStatusRunning
+	job.StartTime = time.Now()
+	job.EndTime = NotRunTime
+	j := &localJob{
+		LocalJob: LocalJob{Job: job},
+		output:   &tailBuffer{max: maxLocalJobOutput},
+	}
+	e.jobs[job.ID] = j
+	e.lock.Unlock()
+
+	log.Infof("Starting local job %d", job.ID)
+	go e.run(j, dir)
+	return job, nil
+}
+
+func (e *localExecutor) GetJob(ID dockworker.JobID) (dockworker.Job, error) {
+	j, err := e.FindJob(ID)
+	return j.Job, err
+}
+
+func (e *localExecutor) FindJob(ID dockworker.JobID) (LocalJob, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	j, ok := e.jobs[ID]
+	if !ok {
+		return LocalJob{}, ErrLocalJobNotFound
+	}
+	job := j.LocalJob
+	job.Output = j.output.String()
+	return job, nil
+}
+
+func (e *localExecutor) StopJob(ID dockworker.JobID) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	j, ok := e.jobs[ID]
+	if !ok {
+		return ErrLocalJobNotFound
+	}
+	if jobDone(j.Job) {
+		return nil
+	}
+	j.stopped = true
+	if j.process != nil {
+		// kill everything the command started, which
+		// would otherwise keep its output open
+		return syscall.Kill(-j.process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
+
+func (e *localExecutor) Stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopChan)
+	})
+}
+
+func (e *localExecutor) JobURL(ID dockworker.JobID) string {
+	return fmt.Sprintf("%s/%d", e.jobURL, ID)
+}
+
+func (e *localExecutor) run(j *localJob, dir string) {
+	defer os.RemoveAll(dir)
+	e.send(j.Job)
+
+	var env []string
+	for _, k := range localJobEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	for k, v := range j.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	status := dockworker.JobStatusSuccessful
+	exitCode := 0
+	for _, c := range j.Cmds {
+		if len(c) == 0 {
+			continue
+		}
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Dir = dir
+		cmd.Env = env
+		cmd.Stdout = j.output
+		cmd.Stderr = j.output
+		cmd.WaitDelay = localJobWaitDelay
+		// the command leads a process group so it can be stopped
+		// along with everything it starts
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+		e.lock.Lock()
+		if j.stopped {
+			e.lock.Unlock()
+			status = dockworker.JobStatusStopped
+			break
+		}
+		err := cmd.Start()
+		if err == nil {
+			j.process = cmd.Process
+		}
+		e.lock.Unlock()
+		if err != nil {
+			fmt.Fprintf(j.output, "Failed to start %v: %s\n", []string(c), err)
+			status = dockworker.JobStatusError
+			exitCode = -1
+			break
+		}
+
+		err = cmd.Wait()
+		if err == exec.ErrWaitDelay {
+			// the command succeeded, only its output was cut off
+			err = nil
+		}
+		exitCode = exitStatus(cmd, err)
+		e.lock.Lock()
+		j.process = nil
+		stopped := j.stopped
+		e.lock.Unlock()
+		if stopped {
+			status = dockworker.JobStatusStopped
+			break
+		}
+		if err != nil {
+			status = dockworker.JobStatusFailed
+			break
+		}
+	}
+
+	e.lock.Lock()
+	j.Status = status
+	j.ExitCode = exitCode
+	j.EndTime = time.Now()
+	job := j.Job
+	e.finished = append(e.finished, job.ID)
+	if len(e.finished) > localJobRetention {
+		delete(e.jobs, e.finished[0])
+		e.finished = e.finished[1:]
+	}
+	e.lock.Unlock()
+	log.Infof("Local job %d finished with status %s and exit code %d", job.ID, job.Status, exitCode)
+	e.send(job)
+}
+
+// send sends an update for a job unless the executor has been stopped
+func (e *localExecutor) send(job dockworker.Job) {
+	select {
+	case e.webhookChan <- job:
+	case <-e.stopChan:
+		log.Debugf("Dropped update for local job %d after stopping", job.ID)
+	}
+}
+
+// exitStatus returns the exit code of a command which has
+// been waited for, or -1 if it didn't exit normally
+func exitStatus(cmd *exec.Cmd, err error) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	lock      sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.buf.Write(p)
+	if b.buf.Len() > 2*b.max {
+		tail := b.buf.Bytes()[b.buf.Len()-b.max:]
+		kept := make([]byte, len(tail))
+		copy(kept, tail)
+		b.buf.Reset()
+		b.buf.Write(kept)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s := b.buf.String()
+	if len(s) <= b.max && !b.truncated {
+		return s
+	}
+	if len(s) > b.max {
+		s = s[len(s)-b.max:]
+	}
+	return "...\n" + s
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bbokorney/dockworker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallLocalExecutor(t *testing.T) {
+	webhookChan := make(chan dockworker.Job, 10)
+	executor := NewLocalExecutor(webhookChan, "http://pipeline/local/jobs")
+	os.Setenv("PIPELINE_WEBHOOKSECRET", "secret")
+	defer os.Unsetenv("PIPELINE_WEBHOOKSECRET")
+
+	job, err := executor.CreateJob(dockworker.Job{
+		Cmds: []dockworker.Cmd{
+			dockworker.Cmd{"sh", "-c", "echo $GREETING ${PIPELINE_WEBHOOKSECRET:-unset}"},
+			dockworker.Cmd{"sh", "-c", "exit 3"},
+			dockworker.Cmd{"sh", "-c", "echo not run"},
+		},
+		Env: map[string]string{"GREETING": "hello"},
+	})
+	if !assert.Nil(t, err, "Job should be created") {
+		return
+	}
+	assert.True(t, job.ID < 0, "Local job IDs should be negative")
+	assert.Equal(t, "http://pipeline/local/jobs/-1", executor.JobURL(-1), "Job URL should match")
+
+	assert.Equal(t, dockworker.JobStatusRunning, (<-webhookChan).Status, "Running update should be sent")
+	update := <-webhookChan
+	assert.Equal(t, job.ID, update.ID, "Update should be for the job")
+	assert.Equal(t, dockworker.JobStatusFailed, update.Status, "Job should fail")
+	local, err := executor.FindJob(job.ID)
+	assert.Nil(t, err, "Job should be found")
+	assert.Equal(t, 3, local.ExitCode, "Exit code should be kept")
+	assert.Equal(t, "hello unset\n", local.Output, "Output should be kept without the service's config")
+
+	// the shell's child holds its output open until it's killed too
+	for _, cmd := range []dockworker.Cmd{{"sleep", "10"}, {"sh", "-c", "sleep 10; echo done"}} {
+		job, err = executor.CreateJob(dockworker.Job{Cmds: []dockworker.Cmd{cmd}})
+		if !assert.Nil(t, err, "Job should be created") {
+			return
+		}
+		<-webhookChan
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, executor.StopJob(job.ID), "Job should be stopped")
+		select {
+		case update = <-webhookChan:
+			assert.Equal(t, dockworker.JobStatusStopped, update.Status, "Job %v should be stopped", cmd)
+		case <-time.After(time.Second):
+			t.Errorf("Stopped job %v should finish quickly", cmd)
+		}
+	}
+
+	// updates aren't waited on once nothing receives them
+	executor.Stop()
+	job, err = executor.CreateJob(dockworker.Job{Cmds: []dockworker.Cmd{dockworker.Cmd{"true"}}})
+	assert.Nil(t, err, "Job should be created")
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if local, _ := executor.FindJob(job.ID); jobDone(local.Job) {
+			break
+		}
+	}
+	local, _ = executor.FindJob(job.ID)
+	assert.Equal(t, dockworker.JobStatusSuccessful, local.Status, "Job should finish without its updates being received")
+
+	_, err = executor.GetJob(1)
+	assert.Equal(t, ErrLocalJobNotFound, err, "Unknown job should not be found")
+}
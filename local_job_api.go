@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/bbokorney/dockworker"
+	"github.com/emicklei/go-restful"
+)
+
+// LocalJobAPI serves the details of the jobs run by the local executor
+type LocalJobAPI struct {
+	executor LocalExecutor
+}
+
+// NewLocalJobAPI returns a new LocalJobAPI
+func NewLocalJobAPI(executor LocalExecutor) LocalJobAPI {
+	return LocalJobAPI{
+		executor: executor,
+	}
+}
+
+// Register adds the routes to the web service container
+func (api LocalJobAPI) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	ws.Path("/local/jobs").
+		Produces(restful.MIME_JSON)
+
+	ws.Route(ws.GET("/{id}").To(api.findJob).
+		Operation("findLocalJob").
+		Param(ws.PathParameter("id", "id of job").DataType("int")).
+		Writes(LocalJob{}))
+
+	container.Add(ws)
+}
+
+func (api LocalJobAPI) findJob(request *restful.Request, response *restful.Response) {
+	id, err := strconv.Atoi(request.PathParameter("id"))
+	if err != nil {
+		response.WriteHeaderAndEntity(http.StatusNotFound, errorResponse("ID must be int"))
+		return
+	}
+	job, err := api.executor.FindJob(dockworker.JobID(id))
+	if err != nil {
+		switch err {
+		case ErrLocalJobNotFound:
+			logAndRespondError(response, http.StatusNotFound, err)
+		default:
+			logAndRespondError(response, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, job)
+}
@@ -2,13 +2,35 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 func main() {
-	wsContainer := doInit()
-	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", config.BindAddress, config.BindPort),
-		wsContainer))
+	a := doInit()
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.BindAddress, config.BindPort))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Handler: a.container}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Serve(listener)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Infof("Received %s, shutting down", sig)
+	}
+	a.shutdown(server)
+	log.Info("Shutdown complete")
 }
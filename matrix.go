@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// matrixInstanceName returns the name of the
+// step created for an instance of a matrix step
+func matrixInstanceName(step Step, index int) string {
+	name := step.Matrix[index].Name
+	if name == "" {
+		name = strconv.Itoa(index)
+	}
+	return fmt.Sprintf("%s[%s]", step.Name, name)
+}
+
+// expandMatrix replaces each step which has a matrix with a step
+// for each of its instances. Steps which depend on a matrix step
+// depend on all of its instances instead. The steps of the
+// given pipeline are not modified.
+func expandMatrix(pipeline Pipeline) Pipeline {
+	instances := make(map[string][]string)
+	for _, step := range pipeline.Steps {
+		for i := range step.Matrix {
+			instances[step.Name] = append(instances[step.Name], matrixInstanceName(*step, i))
+		}
+	}
+	if len(instances) == 0 {
+		return pipeline
+	}
+
+	var expanded []*Step
+	for _, step := range pipeline.Steps {
+		after := expandAfter(step.After, instances)
+		if len(step.Matrix) == 0 {
+			expandedStep := *step
+			expandedStep.After = after
+			expanded = append(expanded, &expandedStep)
+			continue
+		}
+		for i, instance := range step.Matrix {
+			instanceStep := *step
+			instanceStep.Name = matrixInstanceName(*step, i)
+			instanceStep.MatrixOf = step.Name
+			instanceStep.Matrix = nil
+			instanceStep.After = after
+			if instance.ImageName != "" {
+				instanceStep.ImageName = instance.ImageName
+			}
+			instanceStep.Env = make(map[string]string)
+			for k, v := range step.Env {
+				instanceStep.Env[k] = v
+			}
+			for k, v := range instance.Env {
+				instanceStep.Env[k] = v
+			}
+			expanded = append(expanded, &instanceStep)
+		}
+	}
+	pipeline.Steps = expanded
+	return pipeline
+}
+
+func expandAfter(after []string, instances map[string][]string) []string {
+	var expanded []string
+	for _, dep := range after {
+		if names, ok := instances[dep]; ok {
+			expanded = append(expanded, names...)
+		} else {
+			expanded = append(expanded, dep)
+		}
+	}
+	return expanded
+}
+
+// matrixStatus combines the statuses of the instances of a
+// matrix step, giving successful only if all of them were
+func matrixStatus(steps []*Step, name string) Status {
+	var status Status
+	for _, step := range steps {
+		if step.MatrixOf != name {
+			continue
+		}
+		if step.Status != StatusSuccessful {
+			return step.Status
+		}
+		status = StatusSuccessful
+	}
+	return status
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallExpandMatrix(t *testing.T) {
+	pipeline := Pipeline{
+		Name: "Test Pipeline",
+		Steps: []*Step{
+			&Step{
+				Name:      "test",
+				ImageName: "golang:1.6",
+				Cmds:      []Cmd{"go test"},
+				Env:       map[string]string{"A": "1", "B": "2"},
+				Matrix: []MatrixInstance{
+					{Name: "go1.6"},
+					{Name: "go1.7", ImageName: "golang:1.7", Env: map[string]string{"B": "3"}},
+					{},
+				},
+			},
+			&Step{
+				Name:      "deploy",
+				ImageName: "deployer",
+				Cmds:      []Cmd{"deploy"},
+				After:     []string{"test"},
+			},
+		},
+	}
+	assert.Nil(t, ValidatePipeline(pipeline), "Matrix pipeline should be valid")
+
+	expanded := expandMatrix(pipeline)
+	assert.Equal(t, 4, len(expanded.Steps), "Each instance should be a step")
+	assert.Equal(t, []string{"test"}, pipeline.Steps[1].After, "Original steps should be unchanged")
+
+	names := []string{"test[go1.6]", "test[go1.7]", "test[2]"}
+	images := []string{"golang:1.6", "golang:1.7", "golang:1.6"}
+	envs := []map[string]string{
+		{"A": "1", "B": "2"},
+		{"A": "1", "B": "3"},
+		{"A": "1", "B": "2"},
+	}
+	for i := range names {
+		assert.Equal(t, names[i], expanded.Steps[i].Name, "Instance %d name should match", i)
+		assert.Equal(t, images[i], expanded.Steps[i].ImageName, "Instance %d image should match", i)
+		assert.Equal(t, envs[i], expanded.Steps[i].Env, "Instance %d env should match", i)
+		assert.Equal(t, "test", expanded.Steps[i].MatrixOf, "Instance %d should refer to its step", i)
+		assert.Nil(t, expanded.Steps[i].Matrix, "Instance %d should have no matrix", i)
+	}
+	assert.Equal(t, names, expanded.Steps[3].After, "Dependents should wait for every instance")
+	assert.Nil(t, ValidatePipeline(expanded), "Expanded pipeline should be valid")
+}
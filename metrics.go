@@ -0,0 +1,22 @@
+package main
+
+import "expvar"
+
+// Metrics are published as JSON at /debug/vars
+var (
+	// reconcileMetrics counts the polling of dockworker for the
+	// jobs of running pipelines, in case their webhooks are lost
+	reconcileMetrics = expvar.NewMap("reconciliation")
+)
+
+const (
+	// metricPolls is the number of times a worker polled its jobs
+	metricPolls = "polls"
+	// metricJobsChecked is the number of jobs polled
+	metricJobsChecked = "jobs_checked"
+	// metricPollErrors is the number of jobs which couldn't be polled
+	metricPollErrors = "errors"
+	// metricUpdatesRecovered is the number of finished jobs
+	// found by polling before their webhook was received
+	metricUpdatesRecovered = "updates_recovered"
+)
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pborman/uuid"
+)
+
+const (
+	// notificationSignatureHeader holds the hex encoded HMAC-SHA256
+	// of the body using the notification secret, prefixed by "sha256="
+	notificationSignatureHeader = "X-Pipeline-Signature"
+	notificationEventHeader     = "X-Pipeline-Event"
+	notificationDeliveryHeader  = "X-Pipeline-Delivery"
+	notificationTimeout         = 10 * time.Second
+)
+
+// Notifier sends a pipeline's notifications
+type Notifier interface {
+	Notify(pipeline Pipeline, event Event)
+	Stop()
+}
+
+// NotificationPayload is the body POSTed to a notification URL
+type NotificationPayload struct {
+	Event    Event    `json:"event"`
+	Pipeline Pipeline `json:"pipeline"`
+}
+
+// NewNotifier returns a new Notifier. Payloads are signed if secret
+// is set, failed deliveries are retried according to retry and
+// undeliverable ones are appended to deadLetterPath if set.
+func NewNotifier(secret string, retry RetryPolicy, deadLetterPath string) Notifier {
+	return &notifier{
+		secret:         []byte(secret),
+		retry:          retry,
+		deadLetterPath: deadLetterPath,
+		client:         &http.Client{Timeout: notificationTimeout},
+		lock:           &sync.Mutex{},
+		deliveries:     &sync.WaitGroup{},
+		stopChan:       make(chan struct{}),
+	}
+}
+
+type notifier struct {
+	secret         []byte
+	retry          RetryPolicy
+	deadLetterPath string
+	client         *http.Client
+	lock           *sync.Mutex
+	deliveries     *sync.WaitGroup
+	stopChan       chan struct{}
+	stopped        bool
+}
+
+type notificationDelivery struct {
+	ID    string
+	URL   string
+	Event Event
+	Body  []byte
+}
+
+// deadLetter is the record of a notification which couldn't be delivered
+type deadLetter struct {
+	Time     time.Time       `json:"time"`
+	Delivery string          `json:"delivery"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+func (n *notifier) Notify(pipeline Pipeline, event Event) {
+	var body []byte
+	for _, notification := range pipeline.Notifications {
+		if !notification.wants(event.Type) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(NotificationPayload{Event: event, Pipeline: pipeline})
+			if err != nil {
+				log.Errorf("Failed to encode notification for pipeline %d: %s", pipeline.ID, err)
+				return
+			}
+		}
+		d := notificationDelivery{
+			ID:    uuid.New(),
+			URL:   notification.URL,
+			Event: event,
+			Body:  body,
+		}
+		n.lock.Lock()
+		if n.stopped {
+			n.lock.Unlock()
+			n.deadLetter(d, 0, fmt.Errorf("Notifier is stopped"))
+			continue
+		}
+		n.deliveries.Add(1)
+		n.lock.Unlock()
+		go n.deliver(d)
+	}
+}
+
+// Stop abandons the retries of any failing notifications,
+// and waits for those being sent to finish
+func (n *notifier) Stop() {
+	n.lock.Lock()
+	if !n.stopped {
+		n.stopped = true
+		close(n.stopChan)
+	}
+	n.lock.Unlock()
+	n.deliveries.Wait()
+}
+
+func (n *notifier) deliver(d notificationDelivery) {
+	defer n.deliveries.Done()
+	attempts := 0
+	for {
+		attempts++
+		err := n.send(d)
+		if err == nil {
+			log.Debugf("Delivered notification %s of %s for pipeline %d to %s",
+				d.ID, d.Event.Type, d.Event.PipelineID, d.URL)
+			return
+		}
+		log.Warnf("Attempt %d to deliver notification %s to %s failed: %s", attempts, d.ID, d.URL, err)
+		if attempts >= n.retry.MaxAttempts {
+			n.deadLetter(d, attempts, err)
+			return
+		}
+		select {
+		case <-time.After(n.retry.delay(attempts)):
+		case <-n.stopChan:
+			n.deadLetter(d, attempts, fmt.Errorf("%s, retries abandoned at shutdown", err))
+			return
+		}
+	}
+}
+
+func (n *notifier) send(d notificationDelivery) error {
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(notificationEventHeader, string(d.Event.Type))
+	req.Header.Set(notificationDeliveryHeader, d.ID)
+	if len(n.secret) > 0 {
+		req.Header.Set(notificationSignatureHeader, "sha256="+signNotification(n.secret, d.Body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Received status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func signNotification(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter records a notification which couldn't be delivered
+// so that it can be inspected and sent again by hand
+func (n *notifier) deadLetter(d notificationDelivery, attempts int, err error) {
+	log.Errorf("Giving up on notification %s of %s for pipeline %d to %s after %d attempts: %s",
+		d.ID, d.Event.Type, d.Event.PipelineID, d.URL, attempts, err)
+	if n.deadLetterPath == "" {
+		return
+	}
+	record, encodeErr := json.Marshal(deadLetter{
+		Time:     time.Now(),
+		Delivery: d.ID,
+		URL:      d.URL,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Payload:  d.Body,
+	})
+	if encodeErr != nil {
+		log.Errorf("Failed to encode dead letter for notification %s: %s", d.ID, encodeErr)
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	f, openErr := os.OpenFile(n.deadLetterPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if openErr != nil {
+		log.Errorf("Failed to open dead letter log %s: %s", n.deadLetterPath, openErr)
+		return
+	}
+	defer f.Close()
+	if _, writeErr := f.Write(append(record, '\n')); writeErr != nil {
+		log.Errorf("Failed to write dead letter for notification %s: %s", d.ID, writeErr)
+	}
+}
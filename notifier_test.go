@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallNotifier(t *testing.T) {
+	lock := &sync.Mutex{}
+	requests := 0
+	var received []*http.Request
+	var bodies [][]byte
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+	}))
+	defer flaky.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	dir, err := ioutil.TempDir("", "notifier")
+	if !assert.Nil(t, err, "Temp dir should be created") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	deadLetterPath := filepath.Join(dir, "dead.log")
+
+	n := NewNotifier("secret", RetryPolicy{MaxAttempts: 2, Backoff: Duration(time.Millisecond)}, deadLetterPath)
+	pipeline := Pipeline{
+		ID:     3,
+		Name:   "notified",
+		Status: StatusFailed,
+		Notifications: []Notification{
+			{URL: flaky.URL},
+			{URL: broken.URL, Events: []EventType{EventPipelineFinished}},
+			{URL: broken.URL, Events: []EventType{EventStepStarted}},
+		},
+	}
+	n.Notify(pipeline, Event{ID: 10, Type: EventPipelineFinished, PipelineID: 3, Status: StatusFailed})
+	n.Notify(pipeline, Event{ID: 11, Type: EventJobCreated, PipelineID: 3})
+	// let the retries happen, stopping would abandon them
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		lock.Lock()
+		delivered := len(received)
+		lock.Unlock()
+		if _, err := os.Stat(deadLetterPath); err == nil && delivered > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	n.Stop()
+
+	assert.Equal(t, 1, len(received), "Notification should be delivered once after a retry")
+	if len(received) == 1 {
+		assert.Equal(t, "sha256="+signNotification([]byte("secret"), bodies[0]),
+			received[0].Header.Get(notificationSignatureHeader), "Notification should be signed")
+		assert.Equal(t, string(EventPipelineFinished), received[0].Header.Get(notificationEventHeader), "Event header should be set")
+		payload := NotificationPayload{}
+		assert.Nil(t, json.Unmarshal(bodies[0], &payload), "Payload should decode")
+		assert.Equal(t, EventID(10), payload.Event.ID, "Payload event should match")
+		assert.Equal(t, StatusFailed, payload.Pipeline.Status, "Payload should have the pipeline state")
+	}
+
+	deadLetters, err := ioutil.ReadFile(deadLetterPath)
+	assert.Nil(t, err, "Dead letter log should be written")
+	lines := strings.Split(strings.TrimSpace(string(deadLetters)), "\n")
+	if assert.Equal(t, 1, len(lines), "Only the broken notification should be dead lettered") {
+		record := deadLetter{}
+		assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record), "Dead letter should decode")
+		assert.Equal(t, broken.URL, record.URL, "Dead letter URL should match")
+		assert.Equal(t, 2, record.Attempts, "Every attempt should be made")
+	}
+}
@@ -1,13 +1,110 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/bbokorney/dockworker"
+)
 
 // Pipeline is a set of Steps
 type Pipeline struct {
-	ID     PipelineID `json:"id"`
-	Name   string     `json:"name"`
-	Steps  []*Step    `json:"steps"`
-	Status Status     `json:"status"`
+	ID         PipelineID `json:"id"`
+	Name       string     `json:"name"`
+	Steps      []*Step    `json:"steps"`
+	Status     Status     `json:"status"`
+	CreateTime time.Time  `json:"create_time"`
+	StartTime  time.Time  `json:"start_time"`
+	EndTime    time.Time  `json:"end_time"`
+	Timeout    Duration   `json:"timeout,omitempty"`
+	// Priority decides which waiting pipelines start and get
+	// job slots first, higher goes first and the default is 0
+	Priority int `json:"priority,omitempty"`
+	// Queue is the team or owner the pipeline belongs to, waiting
+	// pipelines of the same priority are shared fairly between queues
+	Queue string `json:"queue,omitempty"`
+	// TimedOut is set if the pipeline ran for longer than its timeout
+	TimedOut bool `json:"timed_out,omitempty"`
+	// StopRequested is set if the pipeline was asked to stop, such
+	// as when the service shuts down, so it finishes as stopped even
+	// if it is resumed before its jobs have stopped
+	StopRequested bool `json:"stop_requested,omitempty"`
+	// Cancellation is set if the pipeline was cancelled
+	Cancellation *Cancellation `json:"cancellation,omitempty"`
+	// RerunOf is the ID of the pipeline this is a rerun of
+	RerunOf *PipelineID `json:"rerun_of,omitempty"`
+	// Vars are values the steps' images, commands and
+	// env can refer to as ${name}, see vars.go
+	Vars map[string]string `json:"vars,omitempty"`
+	// Template is set if the pipeline was run from a template
+	Template *TemplateRef `json:"template,omitempty"`
+	// Notifications are sent as the pipeline runs
+	Notifications []Notification `json:"notifications,omitempty"`
+	// Journal records the job updates received for the pipeline
+	Journal []JobUpdate `json:"journal,omitempty"`
+	// QueuePosition is the pipeline's place in the queue while it
+	// waits to start or for a job slot, it isn't stored
+	QueuePosition int `json:"queue_position,omitempty"`
+}
+
+// JobUpdate is an entry in a pipeline's journal. There is one
+// entry for each status received for a job, however many
+// times that status was delivered.
+type JobUpdate struct {
+	JobID    dockworker.JobID     `json:"job_id"`
+	Step     string               `json:"step"`
+	Status   dockworker.JobStatus `json:"status"`
+	Source   string               `json:"source"`
+	Received time.Time            `json:"received"`
+	// Deliveries is the number of times the update was received
+	Deliveries int `json:"deliveries"`
+	// Applied is set if the update changed the step's state
+	Applied bool `json:"applied"`
+}
+
+const (
+	// UpdateSourceWebhook is an update received from dockworker
+	UpdateSourceWebhook = "webhook"
+	// UpdateSourcePoll is an update found by polling dockworker
+	UpdateSourcePoll = "poll"
+	// UpdateSourceResume is an update found when resuming a pipeline
+	UpdateSourceResume = "resume"
+)
+
+// Notification is a URL which is sent the pipeline
+// when any of the given events happen to it
+type Notification struct {
+	URL string `json:"url"`
+	// Events defaults to pipeline.finished only
+	Events []EventType `json:"events,omitempty"`
+}
+
+func (n Notification) wants(eventType EventType) bool {
+	if len(n.Events) == 0 {
+		return eventType == EventPipelineFinished
+	}
+	return containsEventType(n.Events, eventType)
+}
+
+// copySteps returns the pipeline with copies of its steps and
+// journal, the parts a worker changes as the pipeline runs, so
+// that changing one doesn't change the other
+func copySteps(p Pipeline) Pipeline {
+	steps := make([]*Step, len(p.Steps))
+	for i, step := range p.Steps {
+		stepCopy := *step
+		stepCopy.Attempts = append([]Attempt(nil), step.Attempts...)
+		steps[i] = &stepCopy
+	}
+	p.Steps = steps
+	p.Journal = append([]JobUpdate(nil), p.Journal...)
+	return p
+}
+
+// Cancellation records who cancelled a Pipeline and when
+type Cancellation struct {
+	By   string    `json:"by"`
+	Time time.Time `json:"time"`
 }
 
 // TODO: investigate omit if empty struct tags
@@ -19,16 +116,77 @@ type Step struct {
 	Cmds      []Cmd             `json:"cmds"`
 	Env       map[string]string `json:"env"`
 	After     []string          `json:"after"`
+	JobID     dockworker.JobID  `json:"job_id"`
 	JobURL    string            `json:"job_url"`
 	Status    Status            `json:"status"`
 	StartTime time.Time         `json:"start_time"`
 	EndTime   time.Time         `json:"end_time"`
+	// Reused is set if the result of the step was
+	// taken from the pipeline this is a rerun of
+	Reused   bool         `json:"reused,omitempty"`
+	Timeout  Duration     `json:"timeout,omitempty"`
+	Retry    *RetryPolicy `json:"retry,omitempty"`
+	Attempts []Attempt    `json:"attempts,omitempty"`
+	// AllowFailure lets the pipeline continue if the step fails
+	AllowFailure bool `json:"allow_failure,omitempty"`
+	// RunAfterAllowedFailure runs the step even if a step
+	// it depends on failed with AllowFailure set
+	RunAfterAllowedFailure bool `json:"run_after_allowed_failure,omitempty"`
+	// When is on_success, on_failure, always or a condition
+	// expression deciding if the step runs, see condition.go
+	When string `json:"when,omitempty"`
+	// Matrix expands the step into a step for each instance
+	Matrix []MatrixInstance `json:"matrix,omitempty"`
+	// MatrixOf is the name of the matrix step this is an instance of
+	MatrixOf string `json:"matrix_of,omitempty"`
+	// Runner chooses the executor which runs the step, see executor.go
+	Runner string `json:"runner,omitempty"`
+	// Shell runs each command with sh -c instead of splitting
+	// it into arguments, for commands which use pipes and such.
+	// The values of vars are passed to the shell as positional
+	// parameters, so the shell's own variables must be written
+	// as $${HOME} to not be taken for references to vars.
+	Shell bool `json:"shell,omitempty"`
+	// WebhookNonce is signed into the webhook URL of the step's
+	// current job, so the URLs given to its earlier jobs, or to the
+	// jobs of an old pipeline with the same ID, can't update it
+	WebhookNonce string `json:"webhook_nonce,omitempty"`
+}
+
+// MatrixInstance overrides parts of a Step for one of its instances
+type MatrixInstance struct {
+	Name      string            `json:"name"`
+	ImageName string            `json:"image"`
+	Env       map[string]string `json:"env"`
+}
+
+// RetryPolicy describes when and how a failed Step is run again
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times to run the step
+	MaxAttempts int `json:"max_attempts"`
+	// Backoff is the delay before the first retry
+	Backoff Duration `json:"backoff"`
+	// Multiplier increases the delay after each retry, defaults to 2
+	Multiplier float64 `json:"multiplier"`
+	// MaxBackoff caps the delay between retries if set
+	MaxBackoff Duration `json:"max_backoff"`
+	// On lists the step statuses to retry, defaults to error only
+	On []Status `json:"on"`
+}
+
+// Attempt is the record of a single run of a Step
+type Attempt struct {
+	JobID     dockworker.JobID `json:"job_id"`
+	JobURL    string           `json:"job_url"`
+	Status    Status           `json:"status"`
+	StartTime time.Time        `json:"start_time"`
+	EndTime   time.Time        `json:"end_time"`
 }
 
 // PipelineID is and identifier for a Pipeline
 type PipelineID int
 
-// Cmd represents a command
+// Cmd represents a command, see command.go for how it is parsed
 type Cmd string
 
 // Status represents the state of a
@@ -42,6 +200,9 @@ const (
 	StatusRunning Status = "running"
 	// StatusSuccessful state indicates the job has completed successfully
 	StatusSuccessful Status = "successful"
+	// StatusSuccessfulWithWarnings state indicates the pipeline has completed
+	// but some of the steps which were allowed to fail did
+	StatusSuccessfulWithWarnings Status = "successful-with-warnings"
 	// StatusFailed state indicates the job has completed with a failure
 	StatusFailed Status = "failed"
 	// StatusStopping state indicates the job is stopping
@@ -52,7 +213,36 @@ const (
 	StatusNotRun Status = "not-run"
 	// StatusStopped state indicates the job was stoped
 	StatusStopped Status = "stopped"
+	// StatusCancelled state indicates the pipeline was cancelled by a user
+	StatusCancelled Status = "cancelled"
+	// StatusRetrying state indicates the step is waiting to be run again
+	StatusRetrying Status = "retrying"
+	// StatusTimedOut state indicates the job ran for longer than its timeout
+	StatusTimedOut Status = "timed-out"
 )
 
 // NotRunTime represents the time for steps which have not been started or ended
 var NotRunTime = time.Unix(0, 0)
+
+// Duration is a time.Duration represented
+// in JSON as a string such as "1m30s"
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
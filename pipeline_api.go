@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
@@ -28,11 +31,36 @@ func (api PipelineAPI) Register(container *restful.Container) {
 		Consumes(restful.MIME_JSON).
 		Produces(restful.MIME_JSON)
 
+	ws.Route(ws.GET("").To(api.listPipelines).
+		Operation("listPipelines").
+		Param(ws.QueryParameter("status", "only pipelines with this status, may be repeated")).
+		Param(ws.QueryParameter("name", "only pipelines with exactly this name")).
+		Param(ws.QueryParameter("name_prefix", "only pipelines with names starting with this prefix")).
+		Param(ws.QueryParameter("created_after", "only pipelines created after this RFC3339 time")).
+		Param(ws.QueryParameter("created_before", "only pipelines created before this RFC3339 time")).
+		Param(ws.QueryParameter("step_status", "only pipelines with a step with this status, may be repeated")).
+		Param(ws.QueryParameter("cursor", "next_cursor from the previous page")).
+		Param(ws.QueryParameter("limit", "maximum number of pipelines to return").DataType("int")).
+		Param(ws.QueryParameter("sort", "asc or desc order of pipeline ID")).
+		Writes(PipelineList{}))
+
 	ws.Route(ws.GET("/{id}").To(api.findPipeline).
 		Operation("findPipeline").
 		Param(ws.PathParameter("id", "id of pipeline").DataType("int")).
 		Writes(Pipeline{}))
 
+	ws.Route(ws.POST("/{id}/cancel").To(api.cancelPipeline).
+		Operation("cancelPipeline").
+		Param(ws.PathParameter("id", "id of pipeline").DataType("int")).
+		Reads(CancelRequest{}).
+		Writes(Pipeline{}))
+
+	ws.Route(ws.POST("/{id}/rerun").To(api.rerunPipeline).
+		Operation("rerunPipeline").
+		Param(ws.PathParameter("id", "id of pipeline").DataType("int")).
+		Reads(RerunRequest{}).
+		Writes(Pipeline{}))
+
 	ws.Route(ws.POST("").To(api.createPipeline).
 		Operation("createPipeline").
 		Reads(Pipeline{}))
@@ -41,12 +69,10 @@ func (api PipelineAPI) Register(container *restful.Container) {
 }
 
 func (api PipelineAPI) findPipeline(request *restful.Request, response *restful.Response) {
-	id, err := strconv.Atoi(request.PathParameter("id"))
-	if err != nil {
-		response.WriteHeaderAndEntity(http.StatusNotFound, errorResponse("ID must be int"))
+	pipelineID, ok := readPipelineID(request, response)
+	if !ok {
 		return
 	}
-	pipelineID := PipelineID(id)
 
 	pipeline, err := api.pipelineService.Find(pipelineID)
 	if err != nil {
@@ -62,6 +88,93 @@ func (api PipelineAPI) findPipeline(request *restful.Request, response *restful.
 	response.WriteHeaderAndEntity(http.StatusOK, pipeline)
 }
 
+func (api PipelineAPI) listPipelines(request *restful.Request, response *restful.Response) {
+	query, err := parsePipelineQuery(request)
+	if err != nil {
+		logAndRespondError(response, http.StatusBadRequest, err)
+		return
+	}
+	list, err := api.pipelineService.Query(query)
+	if err != nil {
+		logAndRespondError(response, http.StatusInternalServerError, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, list)
+}
+
+// CancelRequest is the body of a request to cancel a pipeline
+type CancelRequest struct {
+	By string `json:"by"`
+}
+
+func (api PipelineAPI) cancelPipeline(request *restful.Request, response *restful.Response) {
+	pipelineID, ok := readPipelineID(request, response)
+	if !ok {
+		return
+	}
+	cancelRequest := &CancelRequest{}
+	if request.Request.ContentLength != 0 {
+		if err := request.ReadEntity(cancelRequest); err != nil {
+			logAndRespondError(response, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if cancelRequest.By == "" {
+		cancelRequest.By = request.Request.RemoteAddr
+	}
+
+	pipeline, err := api.pipelineService.Cancel(pipelineID, cancelRequest.By)
+	if err != nil {
+		switch err {
+		case ErrNotFound:
+			logAndRespondError(response, http.StatusNotFound, err)
+		case ErrPipelineDone:
+			logAndRespondError(response, http.StatusConflict, err)
+		default:
+			logAndRespondError(response, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusAccepted, pipeline)
+}
+
+// RerunRequest is the body of a request to rerun a pipeline
+type RerunRequest struct {
+	Mode string `json:"mode"`
+}
+
+func (api PipelineAPI) rerunPipeline(request *restful.Request, response *restful.Response) {
+	pipelineID, ok := readPipelineID(request, response)
+	if !ok {
+		return
+	}
+	rerunRequest := &RerunRequest{Mode: RerunModeAll}
+	if request.Request.ContentLength != 0 {
+		if err := request.ReadEntity(rerunRequest); err != nil {
+			logAndRespondError(response, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	pipeline, err := api.pipelineService.Rerun(pipelineID, rerunRequest.Mode)
+	if err != nil {
+		switch err {
+		case ErrNotFound:
+			logAndRespondError(response, http.StatusNotFound, err)
+		case ErrInvalidRerunMode:
+			logAndRespondError(response, http.StatusBadRequest, err)
+		case ErrPipelineNotDone, ErrNothingToRerun:
+			logAndRespondError(response, http.StatusConflict, err)
+		case ErrShuttingDown:
+			logAndRespondError(response, http.StatusServiceUnavailable, err)
+		default:
+			logAndRespondError(response, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusCreated, pipeline)
+}
+
 func (api PipelineAPI) createPipeline(request *restful.Request, response *restful.Response) {
 	pipeline := &Pipeline{}
 	err := request.ReadEntity(pipeline)
@@ -69,6 +182,8 @@ func (api PipelineAPI) createPipeline(request *restful.Request, response *restfu
 		logAndRespondError(response, http.StatusInternalServerError, err)
 		return
 	}
+	// only pipelines run from a template say they were
+	pipeline.Template = nil
 
 	p, err := api.pipelineService.Add(*pipeline)
 	if err != nil {
@@ -76,13 +191,89 @@ func (api PipelineAPI) createPipeline(request *restful.Request, response *restfu
 			logAndRespondError(response, http.StatusBadRequest, err)
 			return
 		}
+		if err == ErrShuttingDown {
+			logAndRespondError(response, http.StatusServiceUnavailable, err)
+			return
+		}
 		logAndRespondError(response, http.StatusInternalServerError, err)
 		return
 	}
 	response.WriteHeaderAndEntity(http.StatusCreated, p)
 }
 
+func readPipelineID(request *restful.Request, response *restful.Response) (PipelineID, bool) {
+	id, err := strconv.Atoi(request.PathParameter("id"))
+	if err != nil {
+		response.WriteHeaderAndEntity(http.StatusNotFound, errorResponse("ID must be int"))
+		return 0, false
+	}
+	return PipelineID(id), true
+}
+
 func logAndRespondError(response *restful.Response, status int, err error) {
 	log.Infof("Error response %d %s", status, err)
 	response.WriteHeaderAndEntity(status, errorResponse(err.Error()))
 }
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+func parsePipelineQuery(request *restful.Request) (PipelineQuery, error) {
+	params := request.Request.URL.Query()
+	query := PipelineQuery{
+		Statuses:     parseStatuses(params["status"]),
+		Name:         params.Get("name"),
+		NamePrefix:   params.Get("name_prefix"),
+		StepStatuses: parseStatuses(params["step_status"]),
+		Limit:        defaultListLimit,
+	}
+	var err error
+	if v := params.Get("created_after"); v != "" {
+		if query.CreatedAfter, err = time.Parse(time.RFC3339, v); err != nil {
+			return query, fmt.Errorf("created_after must be an RFC3339 time")
+		}
+	}
+	if v := params.Get("created_before"); v != "" {
+		if query.CreatedBefore, err = time.Parse(time.RFC3339, v); err != nil {
+			return query, fmt.Errorf("created_before must be an RFC3339 time")
+		}
+	}
+	if v := params.Get("cursor"); v != "" {
+		ID, err := strconv.Atoi(v)
+		if err != nil {
+			return query, fmt.Errorf("Invalid cursor")
+		}
+		cursor := PipelineID(ID)
+		query.Cursor = &cursor
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return query, fmt.Errorf("limit must be an int between 1 and %d", maxListLimit)
+		}
+		query.Limit = limit
+	}
+	switch params.Get("sort") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		return query, fmt.Errorf("sort must be asc or desc")
+	}
+	return query, nil
+}
+
+// parseStatuses accepts both repeated and comma separated values
+func parseStatuses(values []string) []Status {
+	var statuses []Status
+	for _, value := range values {
+		for _, s := range strings.Split(value, ",") {
+			if s != "" {
+				statuses = append(statuses, Status(s))
+			}
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,45 @@
+//go:build large
+// +build large
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pipelineHostEnvKey is the URL of a service running
+// against a real dockworker, such as the one test.sh starts
+const pipelineHostEnvKey = "PIPELINE_URL"
+
+func contains(i int, slice []string) bool {
+	for _, arg := range slice {
+		if strconv.Itoa(i) == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// TestLargeAPI runs the API test cases against a real
+// dockworker, it is only built with the large tag
+func TestLargeAPI(t *testing.T) {
+	url := os.Getenv(pipelineHostEnvKey)
+	if url == "" {
+		t.Fatalf("Must specify %s", pipelineHostEnvKey)
+	}
+	pipelineURL := fmt.Sprintf("%s/%s", url, "pipelines")
+
+	runlist := os.Args[1:]
+	fmt.Println("Running tests", runlist)
+
+	for i, tc := range apiTestCases {
+		if len(runlist) > 0 && !contains(i, runlist) {
+			continue
+		}
+		runAPITestCase(t, i, tc, pipelineURL, 1*time.Second)
+	}
+}
@@ -6,63 +6,620 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bbokorney/dockworker"
 	"github.com/stretchr/testify/assert"
 )
 
-const (
-	retryCount         = 20
-	pipelineHostEnvKey = "PIPELINE_URL"
-)
+const retryCount = 20
+
+// TestSmallAPI runs the API test cases against a fake
+// dockworker where each second of sleep takes 20ms
+func TestSmallAPI(t *testing.T) {
+	pipelineURL, dw, stop := startFakeApp(0.02, 0, Limits{})
+	defer stop()
+	dw.failCmd("ls notafile")
+	dw.failCmd("ls notafile.txt")
 
-func contains(i int, slice []string) bool {
-	for _, arg := range slice {
-		if strconv.Itoa(i) == arg {
-			return true
+	for i, tc := range apiTestCases {
+		runAPITestCase(t, i, tc, pipelineURL, 20*time.Millisecond)
+	}
+}
+
+func TestSmallAPIScripted(t *testing.T) {
+	pipelineURL, dw, stop := startFakeApp(0.02, 50*time.Millisecond, Limits{})
+	defer stop()
+	dw.script("slow-failure", fakeStepScript{Status: dockworker.JobStatusFailed, Duration: 100 * time.Millisecond})
+	dw.script("delayed", fakeStepScript{WebhookDelay: 100 * time.Millisecond})
+	dw.script("lost", fakeStepScript{DropWebhooks: true})
+	dw.script("broken", fakeStepScript{CreateErr: fmt.Errorf("Dockworker is down")})
+
+	cases := []struct {
+		steps  []string
+		status Status
+	}{
+		{[]string{"slow-failure"}, StatusFailed},
+		{[]string{"delayed"}, StatusSuccessful},
+		// only found by polling
+		{[]string{"lost"}, StatusSuccessful},
+		{[]string{"broken"}, StatusError},
+	}
+	for i, c := range cases {
+		var steps []string
+		for _, name := range c.steps {
+			steps = append(steps, fmt.Sprintf(`{"name": %q, "image": "ubuntu:14.04", "cmds": ["ls"]}`, name))
 		}
+		body := fmt.Sprintf(`{"name": "Scripted", "steps": [%s]}`, strings.Join(steps, ","))
+		resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(body))
+		if !assert.Nil(t, err, "Case %d: Request should succeed", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, "Case %d: Status code should be 201", i)
+		pipeline := decodeBody(t, i, resp.Body)
+		waitUntilDone(t, i, pipelineURL, pipeline.ID, 20*time.Millisecond)
+		assert.Equal(t, c.status, getPipeline(t, i, pipelineURL, pipeline.ID).Status, "Case %d: Status should match", i)
 	}
-	return false
 }
 
-func TestLargeAPI(t *testing.T) {
-	url := os.Getenv(pipelineHostEnvKey)
-	if url == "" {
-		t.Fatalf("Must specify %s", pipelineHostEnvKey)
+func TestSmallAPILimits(t *testing.T) {
+	pipelineURL, _, stop := startFakeApp(0.02, 0, Limits{Pipelines: 1, Jobs: 1})
+	defer stop()
+
+	// the steps have no dependencies but only one job runs at once
+	body := `{"name": "Limited", "steps": [
+		{"name": "a", "image": "ubuntu:14.04", "cmds": ["sleep 2"]},
+		{"name": "b", "image": "ubuntu:14.04", "cmds": ["sleep 2"]},
+		{"name": "c", "image": "ubuntu:14.04", "cmds": ["sleep 2"]}
+	]}`
+	var IDs []PipelineID
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(body))
+		if !assert.Nil(t, err, "Request should succeed") {
+			return
+		}
+		IDs = append(IDs, decodeBody(t, i, resp.Body).ID)
 	}
-	pipelineURL := fmt.Sprintf("%s/%s", url, "pipelines")
+	time.Sleep(20 * time.Millisecond)
+	second := getPipeline(t, 1, pipelineURL, IDs[1])
+	assert.Equal(t, StatusQueued, second.Status, "Second pipeline should wait for the first")
+	assert.Equal(t, 1, second.QueuePosition, "Second pipeline should be first in the queue")
 
-	runlist := os.Args[1:]
-	fmt.Println("Running tests", runlist)
+	for i, ID := range IDs {
+		waitUntilDone(t, i, pipelineURL, ID, 20*time.Millisecond)
+		p := getPipeline(t, i, pipelineURL, ID)
+		assert.Equal(t, StatusSuccessful, p.Status, "Case %d: Pipeline should succeed", i)
+		assert.Equal(t, 0, p.QueuePosition, "Case %d: Finished pipeline should not be queued", i)
+		for j := 1; j < len(p.Steps); j++ {
+			for k := 0; k < j; k++ {
+				overlap := p.Steps[j].StartTime.Before(p.Steps[k].EndTime) && p.Steps[k].StartTime.Before(p.Steps[j].EndTime)
+				assert.False(t, overlap, "Case %d: Steps %d and %d should not run at once", i, k, j)
+			}
+		}
+	}
+}
 
-	for i, tc := range apiTestCases {
-		if len(runlist) > 0 && !contains(i, runlist) {
-			continue
+func TestSmallAPICancel(t *testing.T) {
+	pipelineURL, _, stop := startFakeApp(0.02, 0, Limits{Pipelines: 1})
+	defer stop()
+
+	cancel := func(ID PipelineID) *http.Response {
+		resp, err := http.Post(fmt.Sprintf("%s/%d/cancel", pipelineURL, ID), "application/json",
+			strings.NewReader(`{"by": "alice"}`))
+		if !assert.Nil(t, err, "Cancel request should succeed") {
+			t.FailNow()
+		}
+		return resp
+	}
+
+	body := `{"name": "Cancelled", "steps": [
+		{"name": "a", "image": "ubuntu:14.04", "cmds": ["sleep 50"]},
+		{"name": "b", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["a"]}
+	]}`
+	var IDs []PipelineID
+	for i := 0; i < 2; i++ {
+		resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(body))
+		if !assert.Nil(t, err, "Request should succeed") {
+			return
 		}
-		resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(tc.requestBody))
-		if err != nil {
-			t.Errorf("Case %d: Error sending post request: %s", i, err)
+		IDs = append(IDs, decodeBody(t, i, resp.Body).ID)
+	}
+	running, queued := IDs[0], IDs[1]
+	waitForStepStatus(t, 0, pipelineURL, running, 0, StatusRunning)
+
+	// the second pipeline waits for the first to finish
+	resp := cancel(queued)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "Cancelling queued pipeline should be accepted")
+	p := getPipeline(t, 1, pipelineURL, queued)
+	assert.Equal(t, StatusCancelled, p.Status, "Queued pipeline should be cancelled at once")
+	for _, step := range p.Steps {
+		assert.Equal(t, StatusNotRun, step.Status, "Steps of queued pipeline should not run")
+	}
+
+	resp = cancel(running)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode, "Cancelling running pipeline should be accepted")
+	waitUntilDone(t, 0, pipelineURL, running, 20*time.Millisecond)
+	p = getPipeline(t, 0, pipelineURL, running)
+	assert.Equal(t, StatusCancelled, p.Status, "Running pipeline should be cancelled")
+	if assert.NotNil(t, p.Cancellation, "Cancellation should be recorded") {
+		assert.Equal(t, "alice", p.Cancellation.By, "Canceller should be recorded")
+	}
+	assert.Equal(t, StatusStopped, p.Steps[0].Status, "Running step should be stopped")
+	assert.Equal(t, StatusNotRun, p.Steps[1].Status, "Waiting step should not run")
+
+	for _, ID := range IDs {
+		resp = cancel(ID)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, "Cancelling finished pipeline %d should conflict", ID)
+	}
+	resp = cancel(100)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "Cancelling unknown pipeline should not be found")
+}
+
+func TestSmallAPIRerun(t *testing.T) {
+	pipelineURL, dw, stop := startFakeApp(0.02, 0, Limits{})
+	defer stop()
+	dw.failCmd("ls notafile")
+
+	// report runs always, so succeeds after test fails
+	body := `{"name": "Rerun", "steps": [
+		{"name": "build", "image": "ubuntu:14.04", "cmds": ["ls"]},
+		{"name": "test", "image": "ubuntu:14.04", "cmds": ["ls notafile"], "after": ["build"]},
+		{"name": "report", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["test"], "when": "always"},
+		{"name": "publish", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["report"], "when": "always"},
+		{"name": "lint", "image": "ubuntu:14.04", "cmds": ["ls"]}
+	]}`
+	resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(body))
+	if !assert.Nil(t, err, "Request should succeed") {
+		return
+	}
+	ID := decodeBody(t, 0, resp.Body).ID
+	waitUntilDone(t, 0, pipelineURL, ID, 20*time.Millisecond)
+	original := getPipeline(t, 0, pipelineURL, ID)
+	assert.Equal(t, StatusFailed, original.Status, "Original should fail")
+	assert.Equal(t, StatusSuccessful, original.Steps[2].Status, "Step run always should succeed")
+	assert.Equal(t, StatusSuccessful, original.Steps[3].Status, "Step run always should succeed")
+
+	cases := []struct {
+		mode   string
+		reused []bool
+	}{
+		{RerunModeAll, []bool{false, false, false, false, false}},
+		// the steps after test are run again despite succeeding
+		{RerunModeFailed, []bool{true, false, false, false, true}},
+	}
+	for i, c := range cases {
+		resp, err := http.Post(fmt.Sprintf("%s/%d/rerun", pipelineURL, original.ID), "application/json",
+			strings.NewReader(fmt.Sprintf(`{"mode": %q}`, c.mode)))
+		if !assert.Nil(t, err, "Case %d: Request should succeed", i) {
+			continue
 		}
 		assert.Equal(t, http.StatusCreated, resp.StatusCode, "Case %d: Status code should be 201", i)
+		rerun := decodeBody(t, i, resp.Body)
+		waitUntilDone(t, i, pipelineURL, rerun.ID, 20*time.Millisecond)
+		p := getPipeline(t, i, pipelineURL, rerun.ID)
+		if assert.NotNil(t, p.RerunOf, "Case %d: Original should be recorded", i) {
+			assert.Equal(t, original.ID, *p.RerunOf, "Case %d: Original should be recorded", i)
+		}
+		assert.Equal(t, StatusFailed, p.Status, "Case %d: Rerun should fail again", i)
+		for j, step := range p.Steps {
+			assert.Equal(t, c.reused[j], step.Reused, "Case %d: Step %s reuse should match", i, step.Name)
+			if c.reused[j] {
+				assert.Equal(t, original.Steps[j].JobID, step.JobID, "Case %d: Step %s should keep its job", i, step.Name)
+			} else {
+				assert.NotEqual(t, original.Steps[j].JobID, step.JobID, "Case %d: Step %s should run again", i, step.Name)
+			}
+		}
+	}
+
+	// the rerun keeps the original's expanded matrix steps
+	body = `{"name": "Rerun matrix", "steps": [
+		{"name": "test", "image": "ubuntu:14.04", "cmds": ["ls notafile"], "matrix": [{"name": "a"}, {"name": "b"}]},
+		{"name": "report", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["test"], "when": "status('test') != 'successful'"}
+	]}`
+	original = runPipeline(t, 0, pipelineURL, body)
+	if original == nil {
+		return
+	}
+	assert.Equal(t, StatusSuccessful, original.Steps[2].Status, "Step after the failed matrix should succeed")
+	for i, mode := range []string{RerunModeAll, RerunModeFailed} {
+		resp, err := http.Post(fmt.Sprintf("%s/%d/rerun", pipelineURL, original.ID), "application/json",
+			strings.NewReader(fmt.Sprintf(`{"mode": %q}`, mode)))
+		if !assert.Nil(t, err, "Matrix case %d: Request should succeed", i) {
+			continue
+		}
+		assert.Equal(t, http.StatusCreated, resp.StatusCode, "Matrix case %d: Status code should be 201", i)
+		rerun := decodeBody(t, i, resp.Body)
+		waitUntilDone(t, i, pipelineURL, rerun.ID, 20*time.Millisecond)
+		p := getPipeline(t, i, pipelineURL, rerun.ID)
+		if assert.Equal(t, 3, len(p.Steps), "Matrix case %d: Steps should not be expanded again", i) {
+			assert.Equal(t, "test[a]", p.Steps[0].Name, "Matrix case %d: Instance should be kept", i)
+			assert.Equal(t, StatusSuccessful, p.Steps[2].Status, "Matrix case %d: Step after the matrix should run", i)
+		}
+	}
+}
 
-		pipelinePOST := decodeBody(t, i, resp.Body)
-		assert.Equal(t, tc.pipeline.Name, pipelinePOST.Name, "Case %d: Pipeline name should be unchanged", i)
-		compareStepData(t, i, tc.pipeline.Steps, pipelinePOST.Steps)
-		assert.Equal(t, StatusQueued, pipelinePOST.Status, "Case %d: Status should be queued", i)
+func TestSmallAPIRetries(t *testing.T) {
+	pipelineURL, dw, stop := startFakeApp(0.02, 0, Limits{})
+	defer stop()
+	dw.script("flaky", fakeStepScript{Attempts: []dockworker.JobStatus{
+		dockworker.JobStatusError, dockworker.JobStatusError, dockworker.JobStatusSuccessful}})
+	dw.script("broken", fakeStepScript{Status: dockworker.JobStatusError})
+	dw.script("failing", fakeStepScript{Status: dockworker.JobStatusFailed})
 
-		waitUntilDone(t, i, pipelineURL, pipelinePOST.ID)
-		pipelineGET := getPipeline(t, i, pipelineURL, pipelinePOST.ID)
-		assert.Equal(t, tc.pipeline.Status, pipelineGET.Status, "Case %d: Status should match", i)
-		compareStepStatuses(t, i, tc.pipeline.Steps, pipelineGET.Steps)
-		compareStepJobURLs(t, i, tc.pipeline.Steps, pipelineGET.Steps)
-		validateStepTimestampsAndDependencies(t, i, pipelineGET.Steps)
+	cases := []struct {
+		step       string
+		retry      string
+		status     Status
+		stepStatus Status
+		attempts   int
+	}{
+		{"flaky", `{"max_attempts": 3, "backoff": "10ms"}`, StatusSuccessful, StatusSuccessful, 3},
+		// retries exhausted
+		{"flaky", `{"max_attempts": 2, "backoff": "10ms"}`, StatusFailed, StatusError, 2},
+		{"broken", `{"max_attempts": 3, "backoff": "10ms", "multiplier": 1}`, StatusFailed, StatusError, 3},
+		// only errors are retried by default
+		{"failing", `{"max_attempts": 3, "backoff": "10ms"}`, StatusFailed, StatusFailed, 1},
+		{"failing", `{"max_attempts": 3, "backoff": "10ms", "on": ["failed"]}`, StatusFailed, StatusFailed, 3},
+	}
+	for i, c := range cases {
+		dw.resetCreated(c.step)
+		body := fmt.Sprintf(`{"name": "Retried", "steps": [
+			{"name": %q, "image": "ubuntu:14.04", "cmds": ["ls"], "retry": %s},
+			{"name": "after", "image": "ubuntu:14.04", "cmds": ["ls"], "after": [%q]}
+		]}`, c.step, c.retry, c.step)
+		p := runPipeline(t, i, pipelineURL, body)
+		if p == nil {
+			continue
+		}
+		assert.Equal(t, c.status, p.Status, "Case %d: Status should match", i)
+		assert.Equal(t, c.stepStatus, p.Steps[0].Status, "Case %d: Step status should match", i)
+		if assert.Equal(t, c.attempts, len(p.Steps[0].Attempts), "Case %d: Attempts should be recorded", i) {
+			last := p.Steps[0].Attempts[c.attempts-1]
+			assert.Equal(t, p.Steps[0].JobID, last.JobID, "Case %d: Step should have its last job", i)
+			for j := 1; j < c.attempts; j++ {
+				assert.False(t, p.Steps[0].Attempts[j].StartTime.Before(p.Steps[0].Attempts[j-1].EndTime),
+					"Case %d: Attempt %d should start after the one before", i, j)
+			}
+		}
+		if c.status == StatusSuccessful {
+			assert.Equal(t, StatusSuccessful, p.Steps[1].Status, "Case %d: Step after should run", i)
+		} else {
+			assert.Equal(t, StatusNotRun, p.Steps[1].Status, "Case %d: Step after should not run", i)
+		}
+	}
+}
+
+func TestSmallAPITimeouts(t *testing.T) {
+	pipelineURL, _, stop := startFakeApp(0.02, 0, Limits{})
+	defer stop()
+
+	cases := []struct {
+		body     string
+		status   Status
+		timedOut bool
+		steps    []Status
+	}{
+		// the step is stopped after 40ms rather than running for 1s
+		{`{"name": "Step timeout", "steps": [
+			{"name": "slow", "image": "ubuntu:14.04", "cmds": ["sleep 50"], "timeout": "40ms"},
+			{"name": "after", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["slow"]}
+		]}`, StatusFailed, false, []Status{StatusTimedOut, StatusNotRun}},
+		// a step which finishes within its timeout isn't affected
+		{`{"name": "Step within timeout", "steps": [
+			{"name": "quick", "image": "ubuntu:14.04", "cmds": ["sleep 1"], "timeout": "1s"}
+		]}`, StatusSuccessful, false, []Status{StatusSuccessful}},
+		{`{"name": "Pipeline timeout", "timeout": "60ms", "steps": [
+			{"name": "first", "image": "ubuntu:14.04", "cmds": ["sleep 1"]},
+			{"name": "slow", "image": "ubuntu:14.04", "cmds": ["sleep 50"], "after": ["first"]},
+			{"name": "after", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["slow"]}
+		]}`, StatusTimedOut, true, []Status{StatusSuccessful, StatusTimedOut, StatusNotRun}},
+	}
+	for i, c := range cases {
+		start := time.Now()
+		p := runPipeline(t, i, pipelineURL, c.body)
+		if p == nil {
+			continue
+		}
+		assert.True(t, time.Since(start) < 500*time.Millisecond, "Case %d: Pipeline should not wait for the slow step", i)
+		assert.Equal(t, c.status, p.Status, "Case %d: Status should match", i)
+		assert.Equal(t, c.timedOut, p.TimedOut, "Case %d: TimedOut should match", i)
+		for j, status := range c.steps {
+			assert.Equal(t, status, p.Steps[j].Status, "Case %d: Step %d status should match", i, j)
+		}
 	}
 }
 
+func TestSmallAPIAllowFailure(t *testing.T) {
+	pipelineURL, dw, stop := startFakeApp(0.02, 0, Limits{})
+	defer stop()
+	dw.failCmd("ls notafile")
+
+	cases := []struct {
+		body   string
+		status Status
+		steps  []Status
+	}{
+		{`{"name": "Warnings", "steps": [
+			{"name": "lint", "image": "ubuntu:14.04", "cmds": ["ls notafile"], "allow_failure": true},
+			{"name": "build", "image": "ubuntu:14.04", "cmds": ["ls"]}
+		]}`, StatusSuccessfulWithWarnings, []Status{StatusFailed, StatusSuccessful}},
+		// the steps after an allowed failure don't run by default
+		{`{"name": "Skipped", "steps": [
+			{"name": "lint", "image": "ubuntu:14.04", "cmds": ["ls notafile"], "allow_failure": true},
+			{"name": "after", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["lint"]},
+			{"name": "run-after", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["lint"], "run_after_allowed_failure": true}
+		]}`, StatusSuccessfulWithWarnings, []Status{StatusFailed, StatusNotRun, StatusSuccessful}},
+		{`{"name": "No warnings", "steps": [
+			{"name": "lint", "image": "ubuntu:14.04", "cmds": ["ls"], "allow_failure": true}
+		]}`, StatusSuccessful, []Status{StatusSuccessful}},
+		// warnings don't hide a failure, build fails after
+		// lint so that lint isn't stopped by the failure
+		{`{"name": "Failed", "steps": [
+			{"name": "lint", "image": "ubuntu:14.04", "cmds": ["ls notafile"], "allow_failure": true},
+			{"name": "build", "image": "ubuntu:14.04", "cmds": ["sleep 2", "ls notafile"]}
+		]}`, StatusFailed, []Status{StatusFailed, StatusFailed}},
+	}
+	for i, c := range cases {
+		p := runPipeline(t, i, pipelineURL, c.body)
+		if p == nil {
+			continue
+		}
+		assert.Equal(t, c.status, p.Status, "Case %d: Status should match", i)
+		for j, status := range c.steps {
+			assert.Equal(t, status, p.Steps[j].Status, "Case %d: Step %d status should match", i, j)
+		}
+	}
+}
+
+func TestSmallAPIWhen(t *testing.T) {
+	pipelineURL, dw, stop := startFakeApp(0.02, 0, Limits{})
+	defer stop()
+	dw.failCmd("ls notafile")
+
+	steps := `
+		{"name": "cleanup", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["test"], "when": "on_failure"},
+		{"name": "report", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["test"], "when": "always"},
+		{"name": "deploy", "image": "ubuntu:14.04", "cmds": ["ls"], "after": ["test"],
+			"when": "status('test') == 'successful' && vars.branch == 'master'"}`
+	cases := []struct {
+		testCmd string
+		branch  string
+		status  Status
+		steps   []Status
+	}{
+		{"ls", "master", StatusSuccessful, []Status{StatusSuccessful, StatusNotRun, StatusSuccessful, StatusSuccessful}},
+		{"ls", "feature", StatusSuccessful, []Status{StatusSuccessful, StatusNotRun, StatusSuccessful, StatusNotRun}},
+		{"ls notafile", "master", StatusFailed, []Status{StatusFailed, StatusSuccessful, StatusSuccessful, StatusNotRun}},
+	}
+	for i, c := range cases {
+		body := fmt.Sprintf(`{"name": "When", "vars": {"branch": %q}, "steps": [
+			{"name": "test", "image": "ubuntu:14.04", "cmds": [%q]},%s
+		]}`, c.branch, c.testCmd, steps)
+		p := runPipeline(t, i, pipelineURL, body)
+		if p == nil {
+			continue
+		}
+		assert.Equal(t, c.status, p.Status, "Case %d: Status should match", i)
+		for j, status := range c.steps {
+			assert.Equal(t, status, p.Steps[j].Status, "Case %d: Step %s status should match", i, p.Steps[j].Name)
+		}
+	}
+}
+
+// TestSmallAPIRestart stops the service while a pipeline's step is
+// running and checks the pipeline is finished by the service started
+// again on the same store, even if the job can't be looked up at first
+func TestSmallAPIRestart(t *testing.T) {
+	defer func(retry RetryPolicy) { jobLookupRetry = retry }(jobLookupRetry)
+	jobLookupRetry = RetryPolicy{MaxAttempts: 3, Backoff: Duration(10 * time.Millisecond)}
+
+	cases := []struct {
+		script fakeStepScript
+		// downFor is how long the service is stopped for
+		downFor time.Duration
+		// lookupFailures is the number of times looking
+		// up the job fails after the service restarts
+		lookupFailures int
+		status         Status
+		stepStatus     Status
+	}{
+		// finished by its webhook
+		{fakeStepScript{}, 0, 0, StatusSuccessful, StatusSuccessful},
+		{fakeStepScript{}, 0, 2, StatusSuccessful, StatusSuccessful},
+		// finished while the service is stopped
+		{fakeStepScript{DropWebhooks: true}, 150 * time.Millisecond, 0, StatusSuccessful, StatusSuccessful},
+		{fakeStepScript{DropWebhooks: true}, 150 * time.Millisecond, 2, StatusSuccessful, StatusSuccessful},
+		// the lookups are given up on
+		{fakeStepScript{DropWebhooks: true}, 150 * time.Millisecond, 3, StatusFailed, StatusError},
+	}
+	for i, c := range cases {
+		dir, err := ioutil.TempDir("", "pipeline")
+		if !assert.Nil(t, err, "Case %d: Creating store dir should succeed", i) {
+			return
+		}
+		setFakeConfig(0, Limits{})
+		// leave the step running when the service stops
+		config.StoreType = StoreTypeFile
+		config.StoreDir = dir
+		config.DrainMode = DrainModeWait
+		config.DrainTimeout = time.Millisecond
+		dw := newFakeDockworker(nil, 0.02)
+		dw.script("restarted", c.script)
+
+		pipelineURL, stop := startApp(dw)
+		body := `{"name": "Restarted", "steps": [{"name": "restarted", "image": "ubuntu:14.04", "cmds": ["sleep 5"]}]}`
+		resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(body))
+		if !assert.Nil(t, err, "Case %d: Request should succeed", i) {
+			stop()
+			os.RemoveAll(dir)
+			continue
+		}
+		ID := decodeBody(t, i, resp.Body).ID
+		waitForStepStatus(t, i, pipelineURL, ID, 0, StatusRunning)
+		stop()
+		time.Sleep(c.downFor)
+
+		dw.failGetJob(c.lookupFailures)
+		pipelineURL, stop = startApp(dw)
+		waitUntilDone(t, i, pipelineURL, ID, 20*time.Millisecond)
+		p := getPipeline(t, i, pipelineURL, ID)
+		assert.Equal(t, c.status, p.Status, "Case %d: Status should match", i)
+		assert.Equal(t, c.stepStatus, p.Steps[0].Status, "Case %d: Step status should match", i)
+		stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestSmallAPIDrain shuts down the service while a pipeline's
+// step is running and checks the status the pipeline is left with
+func TestSmallAPIDrain(t *testing.T) {
+	cases := []struct {
+		drainMode string
+		// cancel cancels the pipeline once the drain has started
+		cancel bool
+		// timeout is set for a drain which times out before the step
+		// stops, the pipeline is finished when the service restarts
+		timeout bool
+		status  Status
+	}{
+		{DrainModeStop, false, false, StatusStopped},
+		{DrainModeWait, true, false, StatusCancelled},
+		{DrainModeStop, false, true, StatusStopped},
+	}
+	for i, c := range cases {
+		dir, err := ioutil.TempDir("", "pipeline")
+		if !assert.Nil(t, err, "Case %d: Creating store dir should succeed", i) {
+			return
+		}
+		setFakeConfig(0, Limits{})
+		config.StoreType = StoreTypeFile
+		config.StoreDir = dir
+		config.DrainMode = c.drainMode
+		dw := newFakeDockworker(nil, 0.02)
+		if c.timeout {
+			config.DrainTimeout = time.Millisecond
+			// the stopped job is only found when it's looked up
+			dw.script("drained", fakeStepScript{DropWebhooks: true})
+		}
+		pipelineURL, stop := startApp(dw)
+		body := `{"name": "Drained", "steps": [{"name": "drained", "image": "ubuntu:14.04", "cmds": ["sleep 50"]}]}`
+		resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(body))
+		if !assert.Nil(t, err, "Case %d: Request should succeed", i) {
+			stop()
+			os.RemoveAll(dir)
+			continue
+		}
+		ID := decodeBody(t, i, resp.Body).ID
+		waitForStepStatus(t, i, pipelineURL, ID, 0, StatusRunning)
+
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			close(stopped)
+		}()
+		if c.cancel {
+			// new pipelines are refused once the drain has started
+			for j := 0; j < retryCount; j++ {
+				resp, err := http.Post(pipelineURL, "application/json", strings.NewReader("{}"))
+				if err == nil && resp.StatusCode == http.StatusServiceUnavailable {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			resp, err := http.Post(fmt.Sprintf("%s/%d/cancel", pipelineURL, ID), "application/json", nil)
+			if assert.Nil(t, err, "Case %d: Cancel request should succeed", i) {
+				assert.Equal(t, http.StatusAccepted, resp.StatusCode, "Case %d: Cancel should be accepted", i)
+			}
+		}
+		<-stopped
+
+		if c.timeout {
+			pipelineURL, stop = startApp(dw)
+			waitUntilDone(t, i, pipelineURL, ID, 20*time.Millisecond)
+			stop()
+		}
+		store, err := NewFilePipelineStore(dir)
+		if assert.Nil(t, err, "Case %d: Opening the store should succeed", i) {
+			p, err := store.Find(ID)
+			assert.Nil(t, err, "Case %d: Pipeline should be stored", i)
+			assert.Equal(t, c.status, p.Status, "Case %d: Status should match", i)
+			assert.Equal(t, StatusStopped, p.Steps[0].Status, "Case %d: Step should be stopped", i)
+			store.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// startFakeApp runs the service against a fake dockworker
+// and returns the pipelines URL and a func to stop it
+func startFakeApp(timeScale float64, pollInterval time.Duration, limits Limits) (string, *fakeDockworker, func()) {
+	setFakeConfig(pollInterval, limits)
+	dw := newFakeDockworker(nil, timeScale)
+	pipelineURL, stop := startApp(dw)
+	return pipelineURL, dw, stop
+}
+
+// setFakeConfig sets the config the service is run with in the tests
+func setFakeConfig(pollInterval time.Duration, limits Limits) {
+	config = Config{
+		WebhookURL:              "http://pipeline/webhook",
+		WebhookSecret:           "secret",
+		StoreType:               StoreTypeMemory,
+		DrainMode:               DrainModeStop,
+		DrainTimeout:            5 * time.Second,
+		EventHistory:            100,
+		PollInterval:            pollInterval,
+		NotificationMaxAttempts: 1,
+		DefaultRunner:           RunnerDockworker,
+		MaxRunningPipelines:     limits.Pipelines,
+		MaxStepsPerPipeline:     limits.StepsPerPipeline,
+		MaxRunningJobs:          limits.Jobs,
+	}
+}
+
+// startApp runs the service with the current config against the
+// fake dockworker, which sends its webhooks to the new service
+func startApp(dw *fakeDockworker) (string, func()) {
+	webhookChan := make(chan dockworker.Job)
+	dw.sendWebhooksTo(webhookChan)
+	executors := NewExecutorRegistry(config.DefaultRunner)
+	executors.Register(RunnerDockworker, dw)
+	a := newApp(webhookChan, executors)
+	server := httptest.NewServer(a.container)
+	stop := func() {
+		a.shutdown(server.Config)
+		server.Close()
+	}
+	return server.URL + "/pipelines", stop
+}
+
+// runAPITestCase submits the test case's pipeline, checking
+// it every wait until it's done and then checking the result
+func runAPITestCase(t *testing.T, i int, tc apiTestCase, pipelineURL string, wait time.Duration) {
+	resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(tc.requestBody))
+	if err != nil {
+		t.Errorf("Case %d: Error sending post request: %s", i, err)
+		return
+	}
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "Case %d: Status code should be 201", i)
+
+	pipelinePOST := decodeBody(t, i, resp.Body)
+	assert.Equal(t, tc.pipeline.Name, pipelinePOST.Name, "Case %d: Pipeline name should be unchanged", i)
+	compareStepData(t, i, tc.pipeline.Steps, pipelinePOST.Steps)
+	assert.Equal(t, StatusQueued, pipelinePOST.Status, "Case %d: Status should be queued", i)
+
+	waitUntilDone(t, i, pipelineURL, pipelinePOST.ID, wait)
+	pipelineGET := getPipeline(t, i, pipelineURL, pipelinePOST.ID)
+	assert.Equal(t, tc.pipeline.Status, pipelineGET.Status, "Case %d: Status should match", i)
+	compareStepStatuses(t, i, tc.pipeline.Steps, pipelineGET.Steps)
+	compareStepJobURLs(t, i, tc.pipeline.Steps, pipelineGET.Steps)
+	validateStepTimestampsAndDependencies(t, i, pipelineGET.Steps)
+}
+
 func compareStepData(t *testing.T, tcNum int, expectedSteps []*Step, actualSteps []*Step) {
 	assert.Equal(t, len(expectedSteps), len(actualSteps), "Case %d: Length of steps should match", tcNum)
 	for i := range expectedSteps {
@@ -114,17 +671,42 @@ func validateStepTimestampsAndDependencies(t *testing.T, tcNum int, actualSteps
 	}
 }
 
-func waitUntilDone(t *testing.T, tcNum int, pipelineURL string, pipelineID PipelineID) {
+func waitUntilDone(t *testing.T, tcNum int, pipelineURL string, pipelineID PipelineID, wait time.Duration) {
 	for i := 0; i < retryCount; i++ {
 		p := getPipeline(t, tcNum, pipelineURL, pipelineID)
 		if p.Status != StatusRunning && p.Status != StatusQueued && p.Status != StatusStopping {
 			return
 		}
-		time.Sleep(1 * time.Second)
+		time.Sleep(wait)
 	}
 	t.Fatalf("Case %d: Waitied too long for pipeline to complete", tcNum)
 }
 
+// runPipeline submits the pipeline and returns it once it's done
+func runPipeline(t *testing.T, tcNum int, pipelineURL string, body string) *Pipeline {
+	resp, err := http.Post(pipelineURL, "application/json", strings.NewReader(body))
+	if !assert.Nil(t, err, "Case %d: Request should succeed", tcNum) {
+		return nil
+	}
+	if !assert.Equal(t, http.StatusCreated, resp.StatusCode, "Case %d: Status code should be 201", tcNum) {
+		return nil
+	}
+	ID := decodeBody(t, tcNum, resp.Body).ID
+	waitUntilDone(t, tcNum, pipelineURL, ID, 20*time.Millisecond)
+	return getPipeline(t, tcNum, pipelineURL, ID)
+}
+
+// waitForStepStatus waits until the step of the pipeline has the status
+func waitForStepStatus(t *testing.T, tcNum int, pipelineURL string, pipelineID PipelineID, step int, status Status) {
+	for i := 0; i < retryCount; i++ {
+		if getPipeline(t, tcNum, pipelineURL, pipelineID).Steps[step].Status == status {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("Case %d: Waited too long for step %d to be %s", tcNum, step, status)
+}
+
 func getPipeline(t *testing.T, tcNum int, pipelineURL string, ID PipelineID) *Pipeline {
 	resp, err := http.Get(fmt.Sprintf("%s/%d", pipelineURL, ID))
 	if err != nil {
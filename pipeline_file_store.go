@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	fileStoreSnapshotName = "snapshot.json"
+	fileStoreLogName      = "pipelines.log"
+	// number of log records written before the log
+	// is compacted into a new snapshot
+	fileStoreCompactThreshold = 1000
+)
+
+// NewFilePipelineStore returns a PipelineStore which persists
+// pipelines to the given directory. Every change is appended
+// to a log and synced before it is applied in memory, and the
+// log is periodically compacted into a snapshot.
+func NewFilePipelineStore(dir string) (PipelineStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &filePipelineStore{
+		lock:   &sync.RWMutex{},
+		nextID: 0,
+		data:   make(map[PipelineID]Pipeline),
+		dir:    dir,
+	}
+	if err := store.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := store.replayLog(); err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded %d pipelines from %s, next ID is %d", len(store.data), dir, store.nextID)
+	return store, nil
+}
+
+type filePipelineStore struct {
+	lock       *sync.RWMutex
+	nextID     PipelineID
+	data       map[PipelineID]Pipeline
+	dir        string
+	logFile    storeLogFile
+	logRecords int
+	// err is set once a record fails to be written,
+	// after which the store refuses any more changes
+	err error
+}
+
+// storeLogFile is the file the store's log is written to
+type storeLogFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// fileStoreSnapshot is the on-disk format of a compacted store
+type fileStoreSnapshot struct {
+	NextID    PipelineID `json:"next_id"`
+	Pipelines []Pipeline `json:"pipelines"`
+}
+
+// fileStoreRecord is a single entry in the store's log
+type fileStoreRecord struct {
+	NextID   PipelineID `json:"next_id"`
+	Pipeline Pipeline   `json:"pipeline"`
+}
+
+func (store *filePipelineStore) Add(p Pipeline) (Pipeline, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	p.ID = store.nextID
+	if err := store.appendRecord(fileStoreRecord{NextID: p.ID + 1, Pipeline: p}); err != nil {
+		return Pipeline{}, err
+	}
+	store.data[p.ID] = copySteps(p)
+	store.nextID = p.ID + 1
+	return copySteps(p), nil
+}
+
+func (store *filePipelineStore) Find(ID PipelineID) (Pipeline, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	p, ok := store.data[ID]
+	if !ok {
+		return Pipeline{}, ErrNotFound
+	}
+	return copySteps(p), nil
+}
+
+func (store *filePipelineStore) Update(p Pipeline) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if _, ok := store.data[p.ID]; !ok {
+		return ErrNotFound
+	}
+	if err := store.appendRecord(fileStoreRecord{NextID: store.nextID, Pipeline: p}); err != nil {
+		return err
+	}
+	store.data[p.ID] = copySteps(p)
+	return nil
+}
+
+func (store *filePipelineStore) Query(query PipelineQuery) (PipelineList, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return queryPipelines(store.data, query), nil
+}
+
+func (store *filePipelineStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.logFile == nil {
+		return nil
+	}
+	err := store.logFile.Close()
+	store.logFile = nil
+	return err
+}
+
+// appendRecord writes a record to the end of the log and syncs it
+// to disk. Each record is a single line containing a checksum
+// followed by the JSON encoded record, so a record which was only
+// partially written before a crash can be detected and discarded.
+func (store *filePipelineStore) appendRecord(record fileStoreRecord) error {
+	if store.err != nil {
+		return store.err
+	}
+	if store.logFile == nil {
+		return fmt.Errorf("Pipeline store is closed")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+	offset, err := store.logFile.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return store.fail(err)
+	}
+	if _, err := store.logFile.Write([]byte(line)); err != nil {
+		return store.failAppend(offset, err)
+	}
+	if err := store.logFile.Sync(); err != nil {
+		return store.failAppend(offset, err)
+	}
+	store.logRecords++
+	if store.logRecords >= fileStoreCompactThreshold {
+		// the record is already durable in the log so a failed
+		// compaction only means the log keeps growing
+		if err := store.compact(record); err != nil {
+			log.Errorf("Failed to compact pipeline store: %s", err)
+		}
+	}
+	return nil
+}
+
+// failAppend removes whatever part of a record was written from
+// the end of the log, since replaying stops at the first bad record
+// and would lose every record written after it, then fails the store
+func (store *filePipelineStore) failAppend(offset int64, err error) error {
+	if truncErr := store.logFile.Truncate(offset); truncErr != nil {
+		log.Errorf("Failed to remove partially written record from pipeline store log: %s", truncErr)
+	} else if syncErr := store.logFile.Sync(); syncErr != nil {
+		log.Errorf("Failed to sync pipeline store log: %s", syncErr)
+	}
+	return store.fail(err)
+}
+
+// fail stops the store accepting any more changes. After a failed
+// write or sync what is on disk can't be known, so it is only
+// safe to carry on from what is read back at the next start.
+func (store *filePipelineStore) fail(err error) error {
+	store.err = fmt.Errorf("Pipeline store failed to write its log: %s", err)
+	log.Error(store.err)
+	return store.err
+}
+
+// compact writes the current state, including the record which
+// is about to be applied, to a new snapshot and truncates the log
+func (store *filePipelineStore) compact(pending fileStoreRecord) error {
+	snapshot := fileStoreSnapshot{
+		NextID: store.nextID,
+	}
+	if pending.NextID > snapshot.NextID {
+		snapshot.NextID = pending.NextID
+	}
+	for ID, p := range store.data {
+		if ID != pending.Pipeline.ID {
+			snapshot.Pipelines = append(snapshot.Pipelines, p)
+		}
+	}
+	snapshot.Pipelines = append(snapshot.Pipelines, pending.Pipeline)
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(store.path(fileStoreSnapshotName), data); err != nil {
+		return err
+	}
+	// replaying the log over the new snapshot is harmless
+	// so a crash before the truncate loses nothing
+	if err := store.logFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := store.logFile.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	store.logRecords = 0
+	return store.logFile.Sync()
+}
+
+func (store *filePipelineStore) loadSnapshot() error {
+	data, err := ioutil.ReadFile(store.path(fileStoreSnapshotName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snapshot := fileStoreSnapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("Failed to read pipeline store snapshot: %s", err)
+	}
+	for _, p := range snapshot.Pipelines {
+		store.apply(fileStoreRecord{NextID: snapshot.NextID, Pipeline: p})
+	}
+	if snapshot.NextID > store.nextID {
+		store.nextID = snapshot.NextID
+	}
+	return nil
+}
+
+// replayLog applies every intact record in the log and
+// truncates anything after the last intact record
+func (store *filePipelineStore) replayLog() error {
+	f, err := os.OpenFile(store.path(fileStoreLogName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	var goodOffset int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Warnf("Discarding partially written record at offset %d of pipeline store log", goodOffset)
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		record, ok := decodeRecord(line)
+		if !ok {
+			log.Warnf("Discarding corrupt record at offset %d of pipeline store log", goodOffset)
+			break
+		}
+		store.apply(record)
+		store.logRecords++
+		goodOffset += int64(len(line))
+	}
+	if err := f.Truncate(goodOffset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(goodOffset, os.SEEK_SET); err != nil {
+		f.Close()
+		return err
+	}
+	store.logFile = f
+	return nil
+}
+
+func (store *filePipelineStore) apply(record fileStoreRecord) {
+	store.data[record.Pipeline.ID] = record.Pipeline
+	// never let the next ID go backwards
+	if record.NextID > store.nextID {
+		store.nextID = record.NextID
+	}
+	if record.Pipeline.ID >= store.nextID {
+		store.nextID = record.Pipeline.ID + 1
+	}
+}
+
+func (store *filePipelineStore) path(name string) string {
+	return filepath.Join(store.dir, name)
+}
+
+func decodeRecord(line []byte) (fileStoreRecord, bool) {
+	record := fileStoreRecord{}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	parts := bytes.SplitN(line, []byte(" "), 2)
+	if len(parts) != 2 {
+		return record, false
+	}
+	sum, err := strconv.ParseUint(string(parts[0]), 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(parts[1]) {
+		return record, false
+	}
+	if err := json.Unmarshal(parts[1], &record); err != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// writeFileSync atomically replaces the file at path with data
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// sync the directory so the rename itself is durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-store")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFilePipelineStore(dir)
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	p0, err := store.Add(Pipeline{Name: "first", Status: StatusQueued})
+	assert.Nil(t, err, "Add should succeed")
+	p1, err := store.Add(Pipeline{Name: "second", Status: StatusQueued})
+	assert.Nil(t, err, "Add should succeed")
+	assert.Equal(t, PipelineID(0), p0.ID, "First ID should be 0")
+	assert.Equal(t, PipelineID(1), p1.ID, "Second ID should be 1")
+	p1.Status = StatusSuccessful
+	assert.Nil(t, store.Update(p1), "Update should succeed")
+	assert.Equal(t, ErrNotFound, store.Update(Pipeline{ID: 10}), "Update of unknown pipeline should fail")
+	assert.Nil(t, store.Close(), "Close should succeed")
+
+	// simulate a crash part way through writing a record
+	f, err := os.OpenFile(filepath.Join(dir, fileStoreLogName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Error opening log: %s", err)
+	}
+	f.WriteString(`0000abcd {"next_id":3,"pipel`)
+	f.Close()
+
+	store, err = NewFilePipelineStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %s", err)
+	}
+	defer store.Close()
+	found, err := store.Find(p1.ID)
+	assert.Nil(t, err, "Find should succeed after reopening")
+	assert.Equal(t, "second", found.Name, "Name should be persisted")
+	assert.Equal(t, StatusSuccessful, found.Status, "Updated status should be persisted")
+	p2, err := store.Add(Pipeline{Name: "third"})
+	assert.Nil(t, err, "Add should succeed after reopening")
+	assert.Equal(t, PipelineID(2), p2.ID, "IDs should continue after reopening")
+}
+
+// tornLogFile writes only part of each write before failing
+type tornLogFile struct {
+	*os.File
+}
+
+func (f tornLogFile) Write(data []byte) (int, error) {
+	n, _ := f.File.Write(data[:len(data)/2])
+	return n, errors.New("disk full")
+}
+
+func TestSmallFileStoreFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-store")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFilePipelineStore(dir)
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	p0, err := store.Add(Pipeline{Name: "first", Status: StatusQueued})
+	assert.Nil(t, err, "Add should succeed")
+	logPath := filepath.Join(dir, fileStoreLogName)
+	before, _ := os.Stat(logPath)
+	fileStore := store.(*filePipelineStore)
+	fileStore.logFile = tornLogFile{fileStore.logFile.(*os.File)}
+	_, err = store.Add(Pipeline{Name: "second"})
+	assert.NotNil(t, err, "Add should fail when the write fails")
+	after, _ := os.Stat(logPath)
+	assert.Equal(t, before.Size(), after.Size(), "Partially written record should be removed")
+	fileStore.logFile = fileStore.logFile.(tornLogFile).File
+	assert.NotNil(t, store.Update(p0), "Store should refuse changes after a failed write")
+	store.Close()
+
+	// records written after the store is reopened must not be lost
+	// behind the partially written record
+	store, err = NewFilePipelineStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %s", err)
+	}
+	p1, err := store.Add(Pipeline{Name: "third"})
+	assert.Nil(t, err, "Add should succeed after reopening")
+	assert.Equal(t, PipelineID(1), p1.ID, "Failed add should not use an ID")
+	store.Close()
+	store, err = NewFilePipelineStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %s", err)
+	}
+	defer store.Close()
+	found, err := store.Find(p1.ID)
+	assert.Nil(t, err, "Record written after the failed one should be replayed")
+	assert.Equal(t, "third", found.Name, "Record written after the failed one should be replayed")
+}
@@ -1,49 +1,243 @@
 package main
 
-import "github.com/bbokorney/dockworker/client"
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DrainModeWait lets running pipelines finish when shutting down
+	DrainModeWait = "wait"
+	// DrainModeStop stops running pipelines when shutting down
+	DrainModeStop = "stop"
+)
 
 // Manager manages starting and running pipelines
 type Manager interface {
 	NotifyNewPipeline(pipeline Pipeline)
 	Start()
-	Stop()
+	Stop(drainMode string, timeout time.Duration)
+	Draining() bool
+	CancelPipeline(ID PipelineID, cancellation Cancellation) error
+	// QueuePositions are the places of the waiting pipelines in the
+	// queue of pipelines waiting to start, or in the queue of pipelines
+	// waiting for a job slot if they're running, starting from 1
+	QueuePositions() map[PipelineID]int
 }
 
-// NewManager returns a new Manager
-func NewManager(dwClient client.Client, updater Updater, webhookListener WebhookListener) Manager {
-	return manager{
-		dwClient:        dwClient,
-		newPipelineChan: make(chan Pipeline, 100),
+// NewManager returns a new Manager. Pipelines waiting to start are
+// shared between their queues according to queueWeights.
+func NewManager(executors ExecutorRegistry, updater Updater, webhookListener WebhookListener,
+	pipelineStore PipelineStore, pollInterval time.Duration, limits Limits, queueWeights map[string]int) Manager {
+	return &manager{
+		executors:       executors,
+		pipelineStore:   pipelineStore,
 		updater:         updater,
 		webhookListener: webhookListener,
+		lock:            &sync.RWMutex{},
+		workers:         make(map[PipelineID]Worker),
+		workersDone:     &sync.WaitGroup{},
+		pollInterval:    pollInterval,
+		limits:          limits,
+		jobLimiter:      NewJobLimiter(limits.Jobs, queueWeights),
+		scheduler:       NewScheduler(queueWeights),
 	}
 }
 
 type manager struct {
-	dwClient        client.Client
-	newPipelineChan chan Pipeline
+	executors       ExecutorRegistry
+	pipelineStore   PipelineStore
 	updater         Updater
 	webhookListener WebhookListener
+	lock            *sync.RWMutex
+	workers         map[PipelineID]Worker
+	workersDone     *sync.WaitGroup
+	draining        bool
+	pollInterval    time.Duration
+	limits          Limits
+	jobLimiter      JobLimiter
+	// scheduler holds the pipelines waiting for
+	// one of the running pipelines to finish
+	scheduler Scheduler
+}
+
+// NotifyNewPipeline schedules a pipeline to start, it never blocks
+func (m *manager) NotifyNewPipeline(pipeline Pipeline) {
+	m.enqueue(pipeline)
+}
+
+func (m *manager) Start() {
+	m.resumePipelines()
 }
 
-func (m manager) NotifyNewPipeline(pipeline Pipeline) {
-	m.newPipelineChan <- pipeline
+// Stop stops starting new pipelines and drains the running ones.
+// In DrainModeWait running pipelines are left to finish, in
+// DrainModeStop their jobs are stopped. Any pipelines still
+// unfinished after the timeout are resumed on the next start.
+func (m *manager) Stop(drainMode string, timeout time.Duration) {
+	m.lock.Lock()
+	if m.draining {
+		m.lock.Unlock()
+		return
+	}
+	m.draining = true
+	log.Infof("Draining %d running pipelines with mode %s", len(m.workers), drainMode)
+	if drainMode == DrainModeStop {
+		for _, w := range m.workers {
+			w.Stop()
+		}
+	}
+	m.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.workersDone.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Info("All pipelines drained")
+	case <-time.After(timeout):
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		for ID := range m.workers {
+			log.Warnf("Pipeline %d still running after drain timeout", ID)
+		}
+	}
+}
+
+func (m *manager) Draining() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.draining
+}
+
+// CancelPipeline stops a pipeline through its worker, or
+// directly if no worker has been started for it yet
+func (m *manager) CancelPipeline(ID PipelineID, cancellation Cancellation) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if w, running := m.workers[ID]; running {
+		err := w.Cancel(cancellation)
+		if err != ErrWorkerDone {
+			return err
+		}
+		// the worker finished before it could be cancelled,
+		// the pipeline it left in the store decides what happens
+	}
+	m.scheduler.Remove(ID)
+	p, err := m.pipelineStore.Find(ID)
+	if err != nil {
+		return err
+	}
+	if pipelineDone(p) {
+		return ErrPipelineDone
+	}
+	log.Infof("Pipeline %d cancelled by %s before starting", ID, cancellation.By)
+	p.Cancellation = &cancellation
+	p.Status = StatusCancelled
+	p.EndTime = time.Now()
+	for _, step := range p.Steps {
+		if step.Status == StatusQueued {
+			step.Status = StatusNotRun
+		}
+	}
+	return m.updater.UpdatePipeline(p)
 }
 
-func (m manager) Start() {
-	// TODO: ensure only one backgroundWorker is running
-	go m.backgroundWorker()
+// resumePipelines starts workers for any pipelines which
+// were left unfinished by a previous run of the service
+func (m *manager) resumePipelines() {
+	unfinished, err := m.pipelineStore.Query(PipelineQuery{
+		Statuses: []Status{StatusQueued, StatusRunning, StatusStopping},
+	})
+	if err != nil {
+		log.Errorf("Failed to find unfinished pipelines: %s", err)
+		return
+	}
+	m.lock.Lock()
+	for _, p := range unfinished.Pipelines {
+		if p.Status != StatusQueued {
+			log.Infof("Resuming pipeline %d with status %s", p.ID, p.Status)
+			m.startWorker(p, true)
+		}
+	}
+	m.lock.Unlock()
+	// pipelines which hadn't started yet wait their turn again
+	for _, p := range unfinished.Pipelines {
+		if p.Status == StatusQueued {
+			m.enqueue(p)
+		}
+	}
 }
 
-func (m manager) Stop() {
-	// TODO: implement
+// enqueue schedules a pipeline, starting
+// it straight away if there's room
+func (m *manager) enqueue(p Pipeline) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.scheduler.Push(p)
+	m.startQueued()
 }
 
-func (m manager) backgroundWorker() {
-	for {
-		select {
-		case p := <-m.newPipelineChan:
-			go NewWorker(p, m.dwClient, m.webhookListener, m.updater).Run()
+// startQueued starts the scheduled pipelines while there are fewer
+// than the limit running, it must be called with the lock held
+func (m *manager) startQueued() {
+	for m.limits.Pipelines == 0 || len(m.workers) < m.limits.Pipelines {
+		if m.draining {
+			// the queued pipelines are picked up on the next start
+			return
 		}
+		p, ok := m.scheduler.Pop()
+		if !ok {
+			return
+		}
+		m.startWorker(p, false)
 	}
+	log.Debugf("%d pipelines queued behind %d running", m.scheduler.Len(), len(m.workers))
+}
+
+func (m *manager) QueuePositions() map[PipelineID]int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	// a pipeline is only ever in one of the queues
+	positions := m.jobLimiter.Positions()
+	for ID, position := range m.scheduler.Positions() {
+		positions[ID] = position
+	}
+	return positions
+}
+
+// startWorker must be called with the lock held
+func (m *manager) startWorker(p Pipeline, resume bool) {
+	if m.draining {
+		return
+	}
+	// the pipeline may have been cancelled while it was waiting
+	if current, err := m.pipelineStore.Find(p.ID); err == nil && pipelineDone(current) {
+		log.Infof("Not starting pipeline %d with status %s", p.ID, current.Status)
+		return
+	}
+	w := NewWorker(p, m.executors, m.webhookListener, m.updater, m.pollInterval,
+		m.jobLimiter, m.limits.StepsPerPipeline)
+	m.workers[p.ID] = w
+	m.workersDone.Add(1)
+	go func() {
+		defer m.workerDone(p.ID)
+		if resume {
+			w.Resume()
+		} else {
+			w.Run()
+		}
+	}()
+}
+
+func (m *manager) workerDone(ID PipelineID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.workers, ID)
+	m.workersDone.Done()
+	m.startQueued()
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PipelineQuery describes a search for pipelines.
+// Zero valued fields do not filter the results.
+type PipelineQuery struct {
+	Statuses      []Status
+	Name          string
+	NamePrefix    string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	StepStatuses  []Status
+	// Cursor is the ID of the last pipeline of the previous page
+	Cursor     *PipelineID
+	Limit      int
+	Descending bool
+}
+
+// PipelineList is a page of pipelines matching a query
+type PipelineList struct {
+	Pipelines  []Pipeline `json:"pipelines"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+func (q PipelineQuery) matches(p Pipeline) bool {
+	if len(q.Statuses) > 0 && !containsStatus(q.Statuses, p.Status) {
+		return false
+	}
+	if q.Name != "" && p.Name != q.Name {
+		return false
+	}
+	if q.NamePrefix != "" && !strings.HasPrefix(p.Name, q.NamePrefix) {
+		return false
+	}
+	if !q.CreatedAfter.IsZero() && !p.CreateTime.After(q.CreatedAfter) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !p.CreateTime.Before(q.CreatedBefore) {
+		return false
+	}
+	if len(q.StepStatuses) > 0 {
+		found := false
+		for _, step := range p.Steps {
+			if containsStatus(q.StepStatuses, step.Status) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.Cursor != nil {
+		if q.Descending && p.ID >= *q.Cursor {
+			return false
+		}
+		if !q.Descending && p.ID <= *q.Cursor {
+			return false
+		}
+	}
+	return true
+}
+
+// queryPipelines runs the query against a set of pipelines,
+// ordering the results by ID
+func queryPipelines(data map[PipelineID]Pipeline, q PipelineQuery) PipelineList {
+	pipelines := []Pipeline{}
+	for _, p := range data {
+		if q.matches(p) {
+			pipelines = append(pipelines, p)
+		}
+	}
+	if q.Descending {
+		sort.Sort(sort.Reverse(byID(pipelines)))
+	} else {
+		sort.Sort(byID(pipelines))
+	}
+	list := PipelineList{Pipelines: pipelines}
+	if q.Limit > 0 && len(pipelines) > q.Limit {
+		list.Pipelines = pipelines[:q.Limit]
+		list.NextCursor = strconv.Itoa(int(list.Pipelines[q.Limit-1].ID))
+	}
+	for i, p := range list.Pipelines {
+		list.Pipelines[i] = copySteps(p)
+	}
+	return list
+}
+
+func containsStatus(statuses []Status, status Status) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type byID []Pipeline
+
+func (p byID) Len() int           { return len(p) }
+func (p byID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byID) Less(i, j int) bool { return p[i].ID < p[j].ID }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallQueryPipelines(t *testing.T) {
+	now := time.Now()
+	data := map[PipelineID]Pipeline{
+		0: Pipeline{ID: 0, Name: "build-app", Status: StatusSuccessful, CreateTime: now.Add(-3 * time.Hour),
+			Steps: []*Step{&Step{Status: StatusSuccessful}}},
+		1: Pipeline{ID: 1, Name: "build-lib", Status: StatusFailed, CreateTime: now.Add(-2 * time.Hour),
+			Steps: []*Step{&Step{Status: StatusFailed}, &Step{Status: StatusNotRun}}},
+		2: Pipeline{ID: 2, Name: "deploy", Status: StatusRunning, CreateTime: now.Add(-1 * time.Hour),
+			Steps: []*Step{&Step{Status: StatusRunning}}},
+		3: Pipeline{ID: 3, Name: "build-app", Status: StatusRunning, CreateTime: now,
+			Steps: []*Step{&Step{Status: StatusRunning}}},
+	}
+
+	ids := func(list PipelineList) []PipelineID {
+		result := []PipelineID{}
+		for _, p := range list.Pipelines {
+			result = append(result, p.ID)
+		}
+		return result
+	}
+
+	assert.Equal(t, []PipelineID{0, 1, 2, 3}, ids(queryPipelines(data, PipelineQuery{})), "Empty query should match all")
+	assert.Equal(t, []PipelineID{2, 3}, ids(queryPipelines(data, PipelineQuery{Statuses: []Status{StatusRunning}})), "Status should filter")
+	assert.Equal(t, []PipelineID{0, 3}, ids(queryPipelines(data, PipelineQuery{Name: "build-app"})), "Name should filter")
+	assert.Equal(t, []PipelineID{0, 1, 3}, ids(queryPipelines(data, PipelineQuery{NamePrefix: "build-"})), "Name prefix should filter")
+	assert.Equal(t, []PipelineID{1}, ids(queryPipelines(data, PipelineQuery{StepStatuses: []Status{StatusNotRun}})), "Step status should filter")
+	assert.Equal(t, []PipelineID{1, 2}, ids(queryPipelines(data, PipelineQuery{
+		CreatedAfter:  now.Add(-150 * time.Minute),
+		CreatedBefore: now.Add(-30 * time.Minute),
+	})), "Creation time should filter")
+
+	page := queryPipelines(data, PipelineQuery{Limit: 3, Descending: true})
+	assert.Equal(t, []PipelineID{3, 2, 1}, ids(page), "First page should be in descending order")
+	assert.Equal(t, "1", page.NextCursor, "Next cursor should be the last ID")
+	cursor := PipelineID(1)
+	page = queryPipelines(data, PipelineQuery{Limit: 3, Descending: true, Cursor: &cursor})
+	assert.Equal(t, []PipelineID{0}, ids(page), "Second page should continue from the cursor")
+	assert.Equal(t, "", page.NextCursor, "Last page should have no cursor")
+}
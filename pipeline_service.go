@@ -1,46 +1,245 @@
 package main
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // PipelineService manages Pipelines
 type PipelineService interface {
 	Add(pipeline Pipeline) (Pipeline, error)
 	Find(ID PipelineID) (Pipeline, error)
+	Query(query PipelineQuery) (PipelineList, error)
+	Cancel(ID PipelineID, by string) (Pipeline, error)
+	Rerun(ID PipelineID, mode string) (Pipeline, error)
 }
 
+const (
+	// RerunModeAll runs every step of the pipeline again
+	RerunModeAll = "all"
+	// RerunModeFailed reuses the results of successful steps
+	// and only runs the failed steps and those after them
+	RerunModeFailed = "failed"
+)
+
+var (
+	// ErrShuttingDown indicates the service is no longer accepting pipelines
+	ErrShuttingDown = errors.New("Service is shutting down")
+	// ErrPipelineDone indicates the pipeline has already finished
+	ErrPipelineDone = errors.New("Pipeline has already finished")
+	// ErrPipelineNotDone indicates the pipeline has not finished yet
+	ErrPipelineNotDone = errors.New("Pipeline has not finished")
+	// ErrInvalidRerunMode indicates an unknown rerun mode
+	ErrInvalidRerunMode = fmt.Errorf("Rerun mode must be %s or %s", RerunModeAll, RerunModeFailed)
+	// ErrNothingToRerun indicates all the steps of the pipeline were successful
+	ErrNothingToRerun = errors.New("Pipeline has no failed steps to rerun")
+)
+
 // NewPipelineService returns a new PipelineService
-func NewPipelineService(pipelineStore PipelineStore, manager Manager) PipelineService {
+func NewPipelineService(pipelineStore PipelineStore, manager Manager, updater Updater,
+	executors ExecutorRegistry) PipelineService {
 	return pipelineService{
 		pipelineStore: pipelineStore,
 		manager:       manager,
+		updater:       updater,
+		executors:     executors,
 	}
 }
 
 type pipelineService struct {
 	pipelineStore PipelineStore
 	manager       Manager
+	updater       Updater
+	executors     ExecutorRegistry
 }
 
 // Add creates a new Pipeline
 func (service pipelineService) Add(pipeline Pipeline) (Pipeline, error) {
+	pipeline.RerunOf = nil
+	for _, step := range pipeline.Steps {
+		if step != nil {
+			resetStep(step)
+		}
+	}
+	return service.submit(pipeline)
+}
+
+// submit validates and queues a pipeline whose steps
+// have already been given their initial state
+func (service pipelineService) submit(pipeline Pipeline) (Pipeline, error) {
+	if service.manager.Draining() {
+		return Pipeline{}, ErrShuttingDown
+	}
+	for _, step := range pipeline.Steps {
+		if step != nil && step.Runner == "" {
+			step.Runner = service.executors.DefaultRunner()
+		}
+	}
 	if err := ValidatePipeline(pipeline); err != nil {
 		return Pipeline{}, err
 	}
-
-	pipeline.Status = StatusQueued
 	for _, step := range pipeline.Steps {
-		step.Status = StatusQueued
-		step.StartTime = time.Unix(0, 0)
-		step.EndTime = time.Unix(0, 0)
+		if _, ok := service.executors.Get(step.Runner); !ok {
+			return Pipeline{}, ValidationError{ErrUnknownRunner}
+		}
 	}
-	p, err := service.pipelineStore.Add(pipeline)
+	pipeline = expandMatrix(pipeline)
+
+	pipeline.Status = StatusQueued
+	pipeline.CreateTime = time.Now()
+	pipeline.StartTime = NotRunTime
+	pipeline.EndTime = NotRunTime
+	pipeline.Cancellation = nil
+	pipeline.TimedOut = false
+	pipeline.StopRequested = false
+	pipeline.Journal = nil
+	pipeline.QueuePosition = 0
+	p, err := service.updater.AddPipeline(pipeline)
 	if err != nil {
 		return Pipeline{}, err
 	}
-	service.manager.NotifyNewPipeline(p)
+	// the worker changes its steps as they run
+	// so it mustn't share them with the caller
+	service.manager.NotifyNewPipeline(copySteps(p))
 	return p, nil
 }
 
 func (service pipelineService) Find(ID PipelineID) (Pipeline, error) {
-	return service.pipelineStore.Find(ID)
+	p, err := service.pipelineStore.Find(ID)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	if !pipelineDone(p) {
+		p.QueuePosition = service.manager.QueuePositions()[p.ID]
+	}
+	return p, nil
+}
+
+func (service pipelineService) Query(query PipelineQuery) (PipelineList, error) {
+	list, err := service.pipelineStore.Query(query)
+	if err != nil {
+		return PipelineList{}, err
+	}
+	// the queues are only played out once for the whole list
+	var positions map[PipelineID]int
+	for i, p := range list.Pipelines {
+		if pipelineDone(p) {
+			continue
+		}
+		if positions == nil {
+			positions = service.manager.QueuePositions()
+		}
+		list.Pipelines[i].QueuePosition = positions[p.ID]
+	}
+	return list, nil
+}
+
+// Cancel stops a pipeline, recording who cancelled it
+func (service pipelineService) Cancel(ID PipelineID, by string) (Pipeline, error) {
+	p, err := service.pipelineStore.Find(ID)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	if pipelineDone(p) {
+		return Pipeline{}, ErrPipelineDone
+	}
+	cancellation := Cancellation{
+		By:   by,
+		Time: time.Now(),
+	}
+	if err := service.manager.CancelPipeline(ID, cancellation); err != nil {
+		return Pipeline{}, err
+	}
+	return service.Find(ID)
+}
+
+// Rerun creates a new pipeline from the definition of an existing one
+func (service pipelineService) Rerun(ID PipelineID, mode string) (Pipeline, error) {
+	if mode != RerunModeAll && mode != RerunModeFailed {
+		return Pipeline{}, ErrInvalidRerunMode
+	}
+	original, err := service.pipelineStore.Find(ID)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	if mode == RerunModeFailed {
+		if !pipelineDone(original) {
+			return Pipeline{}, ErrPipelineNotDone
+		}
+		if original.Status == StatusSuccessful {
+			return Pipeline{}, ErrNothingToRerun
+		}
+	}
+
+	pipeline := Pipeline{
+		Name:          original.Name,
+		Timeout:       original.Timeout,
+		Priority:      original.Priority,
+		Queue:         original.Queue,
+		Vars:          original.Vars,
+		RerunOf:       &original.ID,
+		Template:      original.Template,
+		Notifications: original.Notifications,
+	}
+	rerun := stepsToRerun(original)
+	for _, originalStep := range original.Steps {
+		step := *originalStep
+		if mode == RerunModeFailed && !rerun[step.Name] {
+			step.Reused = true
+		} else {
+			resetStep(&step)
+		}
+		pipeline.Steps = append(pipeline.Steps, &step)
+	}
+	return service.submit(pipeline)
+}
+
+// stepsToRerun returns the steps which a rerun of the failed steps
+// runs again, those which didn't succeed and those which depend on
+// them however indirectly. A step can succeed after one of its
+// dependencies failed, if it runs always or on failure, so its
+// result is only reused if everything it depends on is.
+func stepsToRerun(pipeline Pipeline) map[string]bool {
+	steps := make(map[string]*Step)
+	for _, step := range pipeline.Steps {
+		steps[step.Name] = step
+	}
+	rerun := make(map[string]bool)
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		if r, visited := rerun[name]; visited {
+			return r
+		}
+		step, ok := steps[name]
+		if !ok {
+			return false
+		}
+		r := step.Status != StatusSuccessful
+		// marks the step visited, validation rejects cycles anyway
+		rerun[name] = r
+		for _, dependency := range step.After {
+			if visit(dependency) {
+				r = true
+			}
+		}
+		rerun[name] = r
+		return r
+	}
+	for name := range steps {
+		visit(name)
+	}
+	return rerun
+}
+
+// resetStep clears the results of any previous run of the step
+func resetStep(step *Step) {
+	step.Status = StatusQueued
+	step.StartTime = NotRunTime
+	step.EndTime = NotRunTime
+	step.JobID = 0
+	step.JobURL = ""
+	step.Reused = false
+	step.Attempts = nil
+	step.WebhookNonce = ""
 }
@@ -10,6 +10,8 @@ type PipelineStore interface {
 	Add(pipeline Pipeline) (Pipeline, error)
 	Find(ID PipelineID) (Pipeline, error)
 	Update(p Pipeline) error
+	Query(query PipelineQuery) (PipelineList, error)
+	Close() error
 }
 
 var (
@@ -36,9 +38,9 @@ func (store *inMemPipelineStore) Add(p Pipeline) (Pipeline, error) {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 	p.ID = store.nextID
-	store.data[p.ID] = p
+	store.data[p.ID] = copySteps(p)
 	store.nextID = store.nextID + 1
-	return p, nil
+	return copySteps(p), nil
 }
 
 func (store inMemPipelineStore) Find(ID PipelineID) (Pipeline, error) {
@@ -48,12 +50,22 @@ func (store inMemPipelineStore) Find(ID PipelineID) (Pipeline, error) {
 	if !ok {
 		return Pipeline{}, ErrNotFound
 	}
-	return p, nil
+	return copySteps(p), nil
 }
 
 func (store *inMemPipelineStore) Update(p Pipeline) error {
 	store.lock.Lock()
 	defer store.lock.Unlock()
-	store.data[p.ID] = p
+	store.data[p.ID] = copySteps(p)
+	return nil
+}
+
+func (store inMemPipelineStore) Query(query PipelineQuery) (PipelineList, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return queryPipelines(store.data, query), nil
+}
+
+func (store *inMemPipelineStore) Close() error {
 	return nil
 }
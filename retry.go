@@ -0,0 +1,31 @@
+package main
+
+import "time"
+
+const defaultRetryMultiplier = 2
+
+// delay returns how long to wait before the
+// next attempt, given the number made so far
+func (policy RetryPolicy) delay(attempts int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier == 0 {
+		multiplier = defaultRetryMultiplier
+	}
+	delay := float64(policy.Backoff)
+	for i := 1; i < attempts; i++ {
+		delay *= multiplier
+	}
+	if policy.MaxBackoff > 0 && delay > float64(policy.MaxBackoff) {
+		return time.Duration(policy.MaxBackoff)
+	}
+	return time.Duration(delay)
+}
+
+// retryable checks if a step which finished
+// with the given status should be run again
+func (policy RetryPolicy) retryable(status Status) bool {
+	if len(policy.On) == 0 {
+		return status == StatusError
+	}
+	return containsStatus(policy.On, status)
+}
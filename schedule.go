@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScheduleID is an identifier for a Schedule
+type ScheduleID int
+
+// Schedule submits a pipeline each time its cron expression matches
+type Schedule struct {
+	ID   ScheduleID `json:"id"`
+	Name string     `json:"name"`
+	// Cron is a five field cron expression, see cron.go
+	Cron string `json:"cron"`
+	// Timezone is the IANA name of the zone Cron is in, defaults to UTC
+	Timezone string `json:"timezone,omitempty"`
+	// Overlap is what happens when the schedule is due while the
+	// pipeline it last submitted is still running, defaults to skip
+	Overlap string `json:"overlap,omitempty"`
+	// CatchUp is what happens to the runs missed while the
+	// service wasn't running, defaults to last
+	CatchUp string `json:"catch_up,omitempty"`
+	// Paused stops the schedule submitting pipelines
+	Paused bool `json:"paused,omitempty"`
+	// Pipeline is the definition of the pipeline submitted
+	Pipeline   Pipeline  `json:"pipeline"`
+	CreateTime time.Time `json:"create_time"`
+	// NextRun is the next time the schedule is due
+	NextRun time.Time `json:"next_run"`
+	// PendingRuns are the runs waiting for the previous
+	// pipeline to finish with the queue overlap policy
+	PendingRuns []time.Time `json:"pending_runs,omitempty"`
+	// History is the most recent runs of the schedule, oldest first
+	History []ScheduleRun `json:"history,omitempty"`
+}
+
+// ScheduleRun is the record of a time a schedule was due
+type ScheduleRun struct {
+	// Time is when the run was due
+	Time time.Time `json:"time"`
+	// Submitted is when the pipeline was submitted
+	Submitted time.Time `json:"submitted,omitempty"`
+	// PipelineID is set if a pipeline was submitted
+	PipelineID *PipelineID `json:"pipeline_id,omitempty"`
+	// Skipped is set with the reason if no pipeline was submitted
+	Skipped string `json:"skipped,omitempty"`
+}
+
+const (
+	// OverlapSkip skips the run
+	OverlapSkip = "skip"
+	// OverlapQueue waits for the previous pipeline to finish
+	OverlapQueue = "queue"
+	// OverlapCancelPrevious cancels the previous pipeline
+	OverlapCancelPrevious = "cancel_previous"
+
+	// CatchUpNone skips the missed runs
+	CatchUpNone = "none"
+	// CatchUpLast runs once for the latest missed run
+	CatchUpLast = "last"
+	// CatchUpAll runs once for every missed run
+	CatchUpAll = "all"
+
+	// maxScheduleHistory is the number of runs kept in a schedule's history
+	maxScheduleHistory = 100
+)
+
+// ScheduleStore stores schedules
+type ScheduleStore interface {
+	Add(schedule Schedule) (Schedule, error)
+	Find(ID ScheduleID) (Schedule, error)
+	Update(schedule Schedule) error
+	Delete(ID ScheduleID) error
+	List() ([]Schedule, error)
+}
+
+var (
+	// ErrScheduleNotFound indicates a schedule not found
+	ErrScheduleNotFound = errors.New("Schedule with that ID not found")
+)
+
+// NewScheduleStore returns a new ScheduleStore
+// which keeps schedules in memory only
+func NewScheduleStore() ScheduleStore {
+	return &scheduleStore{
+		lock: &sync.RWMutex{},
+		data: make(map[ScheduleID]Schedule),
+	}
+}
+
+// NewFileScheduleStore returns a ScheduleStore which keeps
+// all the schedules in a file, rewritten on every change
+func NewFileScheduleStore(path string) (ScheduleStore, error) {
+	store := &scheduleStore{
+		lock: &sync.RWMutex{},
+		data: make(map[ScheduleID]Schedule),
+		path: path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file scheduleStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	store.nextID = file.NextID
+	for _, s := range file.Schedules {
+		store.data[s.ID] = s
+	}
+	return store, nil
+}
+
+type scheduleStore struct {
+	lock   *sync.RWMutex
+	nextID ScheduleID
+	data   map[ScheduleID]Schedule
+	// path is where the schedules are saved, if set
+	path string
+}
+
+// scheduleStoreFile is the on-disk format of the schedules
+type scheduleStoreFile struct {
+	NextID    ScheduleID `json:"next_id"`
+	Schedules []Schedule `json:"schedules"`
+}
+
+func (store *scheduleStore) Add(s Schedule) (Schedule, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	s.ID = store.nextID
+	store.data[s.ID] = copySchedule(s)
+	store.nextID++
+	if err := store.save(); err != nil {
+		delete(store.data, s.ID)
+		store.nextID--
+		return Schedule{}, err
+	}
+	return copySchedule(s), nil
+}
+
+func (store *scheduleStore) Find(ID ScheduleID) (Schedule, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	s, ok := store.data[ID]
+	if !ok {
+		return Schedule{}, ErrScheduleNotFound
+	}
+	return copySchedule(s), nil
+}
+
+func (store *scheduleStore) Update(s Schedule) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	old, ok := store.data[s.ID]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	store.data[s.ID] = copySchedule(s)
+	if err := store.save(); err != nil {
+		store.data[s.ID] = old
+		return err
+	}
+	return nil
+}
+
+func (store *scheduleStore) Delete(ID ScheduleID) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	old, ok := store.data[ID]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	delete(store.data, ID)
+	if err := store.save(); err != nil {
+		store.data[ID] = old
+		return err
+	}
+	return nil
+}
+
+func (store *scheduleStore) List() ([]Schedule, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	schedules := store.list()
+	for i, s := range schedules {
+		schedules[i] = copySchedule(s)
+	}
+	return schedules, nil
+}
+
+// list returns the schedules in ID order, it must be called with the lock held
+func (store *scheduleStore) list() []Schedule {
+	var schedules []Schedule
+	for _, s := range store.data {
+		schedules = append(schedules, s)
+	}
+	sort.Sort(bySchedule(schedules))
+	return schedules
+}
+
+// save writes the schedules to the file if there is
+// one, it must be called with the lock held
+func (store *scheduleStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(scheduleStoreFile{
+		NextID:    store.nextID,
+		Schedules: store.list(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileSync(store.path, data)
+}
+
+// copySchedule returns the schedule with copies of the parts
+// which are shared, so changing one doesn't change the other
+func copySchedule(s Schedule) Schedule {
+	s.Pipeline = copySteps(s.Pipeline)
+	s.PendingRuns = append([]time.Time(nil), s.PendingRuns...)
+	s.History = append([]ScheduleRun(nil), s.History...)
+	return s
+}
+
+type bySchedule []Schedule
+
+func (s bySchedule) Len() int           { return len(s) }
+func (s bySchedule) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySchedule) Less(i, j int) bool { return s[i].ID < s[j].ID }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/emicklei/go-restful"
+)
+
+// ScheduleAPI is the Schedule management API
+type ScheduleAPI struct {
+	scheduleService ScheduleService
+}
+
+// NewScheduleAPI returns a new ScheduleAPI
+func NewScheduleAPI(scheduleService ScheduleService) ScheduleAPI {
+	return ScheduleAPI{
+		scheduleService: scheduleService,
+	}
+}
+
+// Register adds the routes to the web service container
+func (api ScheduleAPI) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	ws.Path("/schedules").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	ws.Route(ws.GET("").To(api.listSchedules).
+		Operation("listSchedules").
+		Writes([]Schedule{}))
+
+	ws.Route(ws.GET("/{id}").To(api.findSchedule).
+		Operation("findSchedule").
+		Param(ws.PathParameter("id", "id of schedule").DataType("int")).
+		Writes(Schedule{}))
+
+	ws.Route(ws.POST("").To(api.createSchedule).
+		Operation("createSchedule").
+		Reads(Schedule{}).
+		Writes(Schedule{}))
+
+	ws.Route(ws.PUT("/{id}").To(api.updateSchedule).
+		Operation("updateSchedule").
+		Param(ws.PathParameter("id", "id of schedule").DataType("int")).
+		Reads(Schedule{}).
+		Writes(Schedule{}))
+
+	ws.Route(ws.DELETE("/{id}").To(api.deleteSchedule).
+		Operation("deleteSchedule").
+		Param(ws.PathParameter("id", "id of schedule").DataType("int")))
+
+	container.Add(ws)
+}
+
+func (api ScheduleAPI) listSchedules(request *restful.Request, response *restful.Response) {
+	schedules, err := api.scheduleService.List()
+	if err != nil {
+		logAndRespondError(response, http.StatusInternalServerError, err)
+		return
+	}
+	if schedules == nil {
+		schedules = []Schedule{}
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, schedules)
+}
+
+func (api ScheduleAPI) findSchedule(request *restful.Request, response *restful.Response) {
+	scheduleID, ok := readScheduleID(request, response)
+	if !ok {
+		return
+	}
+	schedule, err := api.scheduleService.Find(scheduleID)
+	if err != nil {
+		respondScheduleError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, schedule)
+}
+
+func (api ScheduleAPI) createSchedule(request *restful.Request, response *restful.Response) {
+	schedule := &Schedule{}
+	if err := request.ReadEntity(schedule); err != nil {
+		logAndRespondError(response, http.StatusBadRequest, err)
+		return
+	}
+	s, err := api.scheduleService.Add(*schedule)
+	if err != nil {
+		respondScheduleError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusCreated, s)
+}
+
+func (api ScheduleAPI) updateSchedule(request *restful.Request, response *restful.Response) {
+	scheduleID, ok := readScheduleID(request, response)
+	if !ok {
+		return
+	}
+	schedule := &Schedule{}
+	if err := request.ReadEntity(schedule); err != nil {
+		logAndRespondError(response, http.StatusBadRequest, err)
+		return
+	}
+	schedule.ID = scheduleID
+	s, err := api.scheduleService.Update(*schedule)
+	if err != nil {
+		respondScheduleError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, s)
+}
+
+func (api ScheduleAPI) deleteSchedule(request *restful.Request, response *restful.Response) {
+	scheduleID, ok := readScheduleID(request, response)
+	if !ok {
+		return
+	}
+	if err := api.scheduleService.Delete(scheduleID); err != nil {
+		respondScheduleError(response, err)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func respondScheduleError(response *restful.Response, err error) {
+	switch {
+	case err == ErrScheduleNotFound:
+		logAndRespondError(response, http.StatusNotFound, err)
+	case isValidationError(err):
+		logAndRespondError(response, http.StatusBadRequest, err)
+	default:
+		logAndRespondError(response, http.StatusInternalServerError, err)
+	}
+}
+
+func readScheduleID(request *restful.Request, response *restful.Response) (ScheduleID, bool) {
+	id, err := strconv.Atoi(request.PathParameter("id"))
+	if err != nil {
+		response.WriteHeaderAndEntity(http.StatusNotFound, errorResponse("ID must be int"))
+		return 0, false
+	}
+	return ScheduleID(id), true
+}
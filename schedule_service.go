@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// scheduleMissedGrace is how late a run can be before it
+	// counts as missed and its catch up policy applies
+	scheduleMissedGrace = time.Minute
+	// schedulePendingCheckInterval is how often schedules with pending
+	// runs check if the pipeline they're waiting on has finished
+	schedulePendingCheckInterval = 5 * time.Second
+	// scheduleMaxWait is the longest the schedules are left unchecked,
+	// in case the clock is changed
+	scheduleMaxWait = time.Minute
+)
+
+// ScheduleService manages Schedules and submits
+// their pipelines when they are due
+type ScheduleService interface {
+	Add(schedule Schedule) (Schedule, error)
+	Find(ID ScheduleID) (Schedule, error)
+	List() ([]Schedule, error)
+	// Update changes the definition of a schedule, keeping its history
+	Update(schedule Schedule) (Schedule, error)
+	Delete(ID ScheduleID) error
+	Start()
+	Stop()
+}
+
+// NewScheduleService returns a new ScheduleService which
+// submits the pipelines of schedules to pipelineService
+func NewScheduleService(scheduleStore ScheduleStore, pipelineService PipelineService) ScheduleService {
+	return &scheduleService{
+		scheduleStore:   scheduleStore,
+		pipelineService: pipelineService,
+		lock:            &sync.Mutex{},
+		wakeChan:        make(chan struct{}, 1),
+		stopChan:        make(chan struct{}),
+		doneChan:        make(chan struct{}),
+		now:             time.Now,
+	}
+}
+
+type scheduleService struct {
+	scheduleStore   ScheduleStore
+	pipelineService PipelineService
+	// lock keeps changes to schedules from
+	// racing with them being run
+	lock     *sync.Mutex
+	wakeChan chan struct{}
+	stopChan chan struct{}
+	doneChan chan struct{}
+	now      func() time.Time
+}
+
+func (service *scheduleService) Add(schedule Schedule) (Schedule, error) {
+	setScheduleDefaults(&schedule)
+	if err := ValidateSchedule(schedule); err != nil {
+		return Schedule{}, err
+	}
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	now := service.now()
+	schedule.CreateTime = now
+	schedule.NextRun = nextScheduleRun(schedule, now)
+	schedule.PendingRuns = nil
+	schedule.History = nil
+	s, err := service.scheduleStore.Add(schedule)
+	if err != nil {
+		return Schedule{}, err
+	}
+	log.Infof("Added schedule %d %s, next run at %s", s.ID, s.Name, s.NextRun)
+	service.wake()
+	return s, nil
+}
+
+func (service *scheduleService) Find(ID ScheduleID) (Schedule, error) {
+	return service.scheduleStore.Find(ID)
+}
+
+func (service *scheduleService) List() ([]Schedule, error) {
+	return service.scheduleStore.List()
+}
+
+func (service *scheduleService) Update(schedule Schedule) (Schedule, error) {
+	setScheduleDefaults(&schedule)
+	if err := ValidateSchedule(schedule); err != nil {
+		return Schedule{}, err
+	}
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	existing, err := service.scheduleStore.Find(schedule.ID)
+	if err != nil {
+		return Schedule{}, err
+	}
+	schedule.CreateTime = existing.CreateTime
+	schedule.History = existing.History
+	// runs still pending are dealt with by the new overlap policy
+	schedule.PendingRuns = existing.PendingRuns
+	schedule.NextRun = nextScheduleRun(schedule, service.now())
+	if err := service.scheduleStore.Update(schedule); err != nil {
+		return Schedule{}, err
+	}
+	service.wake()
+	return schedule, nil
+}
+
+func (service *scheduleService) Delete(ID ScheduleID) error {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	return service.scheduleStore.Delete(ID)
+}
+
+func (service *scheduleService) Start() {
+	go service.run()
+}
+
+// Stop stops submitting pipelines, waiting for any being submitted
+func (service *scheduleService) Stop() {
+	close(service.stopChan)
+	<-service.doneChan
+}
+
+// wake makes the schedules be checked again, such as when
+// one changes, the channel has room for one wake up so
+// this never blocks
+func (service *scheduleService) wake() {
+	select {
+	case service.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (service *scheduleService) run() {
+	defer close(service.doneChan)
+	for {
+		wait := service.runDue()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-service.wakeChan:
+			timer.Stop()
+		case <-service.stopChan:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// runDue runs the schedules which are due and returns
+// how long to wait before checking them again
+func (service *scheduleService) runDue() time.Duration {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	schedules, err := service.scheduleStore.List()
+	if err != nil {
+		log.Errorf("Failed to list schedules: %s", err)
+		return scheduleMaxWait
+	}
+	now := service.now()
+	wait := scheduleMaxWait
+	for _, s := range schedules {
+		if !s.NextRun.After(now) || len(s.PendingRuns) > 0 {
+			service.runSchedule(&s, now)
+			if err := service.scheduleStore.Update(s); err != nil {
+				log.Errorf("Failed to update schedule %d: %s", s.ID, err)
+			}
+		}
+		if len(s.PendingRuns) > 0 && schedulePendingCheckInterval < wait {
+			wait = schedulePendingCheckInterval
+		}
+		if !s.NextRun.IsZero() && s.NextRun.Sub(now) < wait {
+			wait = s.NextRun.Sub(now)
+		}
+	}
+	return wait
+}
+
+// runSchedule submits the schedule's pipeline for each of the runs
+// which are due, according to its catch up and overlap policies
+func (service *scheduleService) runSchedule(s *Schedule, now time.Time) {
+	var onTime, missed []time.Time
+	missedCount := 0
+	if !s.NextRun.IsZero() && !s.NextRun.After(now) {
+		cron, loc, err := scheduleCron(*s)
+		if err != nil {
+			log.Errorf("Schedule %d has an invalid cron expression: %s", s.ID, err)
+			return
+		}
+		for t := s.NextRun; !t.IsZero() && !t.After(now); t = cron.Next(t.In(loc)) {
+			if now.Sub(t) <= scheduleMissedGrace {
+				onTime = append(onTime, t)
+				continue
+			}
+			missedCount++
+			missed = append(missed, t)
+			// only the latest missed runs can be caught up
+			if len(missed) > maxScheduleHistory {
+				missed = missed[1:]
+			}
+		}
+		s.NextRun = cron.Next(now.In(loc))
+	}
+	if s.Paused {
+		return
+	}
+
+	runs := onTime
+	caughtUp := 0
+	switch s.CatchUp {
+	case CatchUpAll:
+		runs = append(missed, onTime...)
+		caughtUp = len(missed)
+	case CatchUpLast:
+		// a run which is on time takes the place of the missed ones
+		if len(onTime) == 0 && len(missed) > 0 {
+			runs = missed[len(missed)-1:]
+			caughtUp = 1
+		}
+	}
+	if skipped := missedCount - caughtUp; skipped > 0 {
+		log.Warnf("Schedule %d missed %d runs while the service wasn't running", s.ID, skipped)
+		addScheduleRun(s, ScheduleRun{
+			Time:    missed[len(missed)-1],
+			Skipped: fmt.Sprintf("Missed %d runs while the service wasn't running", skipped),
+		})
+	}
+
+	runs = append(s.PendingRuns, runs...)
+	s.PendingRuns = nil
+	for i, run := range runs {
+		switch service.overlap(s, run) {
+		case OverlapQueue:
+			s.PendingRuns = runs[i:]
+			if len(s.PendingRuns) > maxScheduleHistory {
+				s.PendingRuns = s.PendingRuns[len(s.PendingRuns)-maxScheduleHistory:]
+			}
+			return
+		case OverlapSkip:
+			continue
+		}
+		service.submit(s, run)
+	}
+}
+
+// overlap applies the overlap policy if the pipeline the schedule last
+// submitted is still running. It returns OverlapQueue if the run must
+// wait for it to finish, OverlapSkip if the run was skipped, or an
+// empty string if the pipeline can be submitted.
+func (service *scheduleService) overlap(s *Schedule, run time.Time) string {
+	previous := lastSubmitted(*s)
+	if previous == nil {
+		return ""
+	}
+	p, err := service.pipelineService.Find(*previous)
+	if err != nil || pipelineDone(p) {
+		return ""
+	}
+	switch s.Overlap {
+	case OverlapQueue:
+		return OverlapQueue
+	case OverlapCancelPrevious:
+		log.Infof("Schedule %d cancelling pipeline %d", s.ID, *previous)
+		_, err := service.pipelineService.Cancel(*previous, fmt.Sprintf("schedule %d", s.ID))
+		if err != nil && err != ErrPipelineDone {
+			log.Errorf("Schedule %d failed to cancel pipeline %d: %s", s.ID, *previous, err)
+		}
+		return ""
+	default:
+		addScheduleRun(s, ScheduleRun{
+			Time:    run,
+			Skipped: fmt.Sprintf("Pipeline %d is still running", *previous),
+		})
+		return OverlapSkip
+	}
+}
+
+func (service *scheduleService) submit(s *Schedule, run time.Time) {
+	p, err := service.pipelineService.Add(copySteps(s.Pipeline))
+	if err != nil {
+		log.Errorf("Schedule %d failed to submit pipeline: %s", s.ID, err)
+		addScheduleRun(s, ScheduleRun{
+			Time:    run,
+			Skipped: fmt.Sprintf("Failed to submit pipeline: %s", err),
+		})
+		return
+	}
+	log.Infof("Schedule %d submitted pipeline %d for %s", s.ID, p.ID, run)
+	addScheduleRun(s, ScheduleRun{
+		Time:       run,
+		Submitted:  service.now(),
+		PipelineID: &p.ID,
+	})
+}
+
+// lastSubmitted returns the ID of the pipeline the schedule submitted last
+func lastSubmitted(s Schedule) *PipelineID {
+	for i := len(s.History) - 1; i >= 0; i-- {
+		if s.History[i].PipelineID != nil {
+			return s.History[i].PipelineID
+		}
+	}
+	return nil
+}
+
+func addScheduleRun(s *Schedule, run ScheduleRun) {
+	s.History = append(s.History, run)
+	if len(s.History) > maxScheduleHistory {
+		s.History = s.History[len(s.History)-maxScheduleHistory:]
+	}
+}
+
+func setScheduleDefaults(s *Schedule) {
+	if s.Overlap == "" {
+		s.Overlap = OverlapSkip
+	}
+	if s.CatchUp == "" {
+		s.CatchUp = CatchUpLast
+	}
+}
+
+// scheduleCron parses the schedule's cron expression and timezone
+func scheduleCron(s Schedule) (cronSchedule, *time.Location, error) {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return cronSchedule{}, nil, err
+	}
+	cron, err := parseCron(s.Cron)
+	return cron, loc, err
+}
+
+// nextScheduleRun is the first time after t the schedule is due
+func nextScheduleRun(s Schedule, t time.Time) time.Time {
+	cron, loc, err := scheduleCron(s)
+	if err != nil {
+		return time.Time{}
+	}
+	return cron.Next(t.In(loc))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePipelineService validates and records the pipelines submitted to it
+type fakePipelineService struct {
+	PipelineService
+	pipelines []Pipeline
+	cancelled []PipelineID
+}
+
+func (service *fakePipelineService) Add(p Pipeline) (Pipeline, error) {
+	if err := ValidatePipeline(p); err != nil {
+		return Pipeline{}, err
+	}
+	p.ID = PipelineID(len(service.pipelines))
+	p.Status = StatusRunning
+	service.pipelines = append(service.pipelines, p)
+	return p, nil
+}
+
+func (service *fakePipelineService) Find(ID PipelineID) (Pipeline, error) {
+	return service.pipelines[ID], nil
+}
+
+func (service *fakePipelineService) Cancel(ID PipelineID, by string) (Pipeline, error) {
+	service.cancelled = append(service.cancelled, ID)
+	service.pipelines[ID].Status = StatusCancelled
+	return service.pipelines[ID], nil
+}
+
+func TestSmallScheduleService(t *testing.T) {
+	pipelines := &fakePipelineService{}
+	service := NewScheduleService(NewScheduleStore(), pipelines).(*scheduleService)
+	now := time.Date(2016, 6, 1, 12, 0, 30, 0, time.UTC)
+	service.now = func() time.Time { return now }
+	definition := Pipeline{Name: "Nightly", Steps: []*Step{&Step{Name: "build", ImageName: "ubuntu:14.04", Cmds: []Cmd{"make"}}}}
+
+	_, err := service.Add(Schedule{Name: "Bad", Cron: "* * *", Pipeline: definition})
+	assert.Equal(t, ValidationError{ErrInvalidCron}, err, "Invalid cron should be rejected")
+	_, err = service.Add(Schedule{Name: "Bad", Cron: "* * * * *", Timezone: "Mars/Olympus", Pipeline: definition})
+	assert.Equal(t, ValidationError{ErrInvalidTimezone}, err, "Unknown timezone should be rejected")
+
+	s, err := service.Add(Schedule{Name: "Hourly", Cron: "0 * * * *", Pipeline: definition})
+	if !assert.Nil(t, err, "Schedule should be added") {
+		return
+	}
+	assert.Equal(t, OverlapSkip, s.Overlap, "Overlap should default to skip")
+	assert.Equal(t, CatchUpLast, s.CatchUp, "Catch up should default to last")
+	assert.Equal(t, time.Date(2016, 6, 1, 13, 0, 0, 0, time.UTC), s.NextRun, "Next run should be the next hour")
+	assert.Equal(t, scheduleMaxWait, service.runDue(), "Should wait no longer than the max")
+
+	now = time.Date(2016, 6, 1, 13, 0, 1, 0, time.UTC)
+	service.runDue()
+	s, _ = service.Find(s.ID)
+	assert.Equal(t, 1, len(pipelines.pipelines), "Pipeline should be submitted")
+	assert.Equal(t, "Nightly", pipelines.pipelines[0].Name, "Pipeline definition should be submitted")
+	if assert.Equal(t, 1, len(s.History), "Run should be recorded") {
+		assert.Equal(t, PipelineID(0), *s.History[0].PipelineID, "Pipeline should be recorded")
+	}
+
+	// the first pipeline is still running, and three runs were missed
+	now = time.Date(2016, 6, 1, 17, 30, 0, 0, time.UTC)
+	service.runDue()
+	s, _ = service.Find(s.ID)
+	assert.Equal(t, 1, len(pipelines.pipelines), "Overlapping run should be skipped")
+	if assert.Equal(t, 3, len(s.History), "Missed and skipped runs should be recorded") {
+		assert.Equal(t, "Missed 3 runs while the service wasn't running", s.History[1].Skipped, "Missed runs should be recorded")
+		assert.Equal(t, time.Date(2016, 6, 1, 17, 0, 0, 0, time.UTC), s.History[2].Time, "Last missed run should be caught up")
+		assert.Equal(t, "Pipeline 0 is still running", s.History[2].Skipped, "Overlapping run should be recorded")
+	}
+	assert.Equal(t, time.Date(2016, 6, 1, 18, 0, 0, 0, time.UTC), s.NextRun, "Next run should be after now")
+
+	// queued runs wait for the previous pipeline
+	s.Overlap = OverlapQueue
+	s.CatchUp = CatchUpAll
+	s, err = service.Update(s)
+	assert.Nil(t, err, "Schedule should be updated")
+	now = time.Date(2016, 6, 1, 20, 0, 0, 0, time.UTC)
+	service.runDue()
+	s, _ = service.Find(s.ID)
+	assert.Equal(t, 3, len(s.PendingRuns), "Runs should wait for the previous pipeline")
+	pipelines.pipelines[0].Status = StatusSuccessful
+	service.runDue()
+	s, _ = service.Find(s.ID)
+	assert.Equal(t, 2, len(pipelines.pipelines), "First pending run should be submitted")
+	assert.Equal(t, 2, len(s.PendingRuns), "Other runs should wait for it")
+
+	// the previous pipeline is cancelled for the new one
+	s.Overlap = OverlapCancelPrevious
+	s, _ = service.Update(s)
+	service.runDue()
+	assert.Equal(t, []PipelineID{1, 2}, pipelines.cancelled, "Previous pipelines should be cancelled")
+	assert.Equal(t, 4, len(pipelines.pipelines), "Pending runs should be submitted")
+
+	assert.Nil(t, service.Delete(s.ID), "Schedule should be deleted")
+	_, err = service.Find(s.ID)
+	assert.Equal(t, ErrScheduleNotFound, err, "Deleted schedule should not be found")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"sort"
+)
+
+// DefaultQueue is the queue of pipelines which don't set one
+const DefaultQueue = "default"
+
+// Scheduler orders the pipelines waiting to start. The pipeline
+// with the highest priority goes first. Between queues with
+// waiting pipelines of the same priority the queues take turns,
+// each getting a share of the turns in proportion to its weight,
+// so a burst of pipelines in one queue can't starve the others.
+// Within a queue pipelines of the same priority go in order.
+type Scheduler interface {
+	Push(pipeline Pipeline)
+	// Pop removes the next pipeline to start
+	Pop() (Pipeline, bool)
+	// Remove takes a pipeline out of the schedule, such as when it is
+	// cancelled before starting, returning true if it was waiting
+	Remove(ID PipelineID) bool
+	// Positions are the places the waiting pipelines would start
+	// in if no more pipelines were added, starting from 1
+	Positions() map[PipelineID]int
+	Len() int
+}
+
+// NewScheduler returns a new Scheduler, queues without
+// a weight in weights have a weight of 1
+func NewScheduler(weights map[string]int) Scheduler {
+	return &scheduler{
+		weights: weights,
+		queues:  make(map[string]*scheduledQueue),
+	}
+}
+
+type scheduler struct {
+	weights map[string]int
+	queues  map[string]*scheduledQueue
+	// seq orders pipelines of the same priority in a queue
+	seq int
+	// vtime is the virtual time of the last pipeline started. A queue
+	// with nothing waiting joins at this time so it can't build up
+	// credit while idle and then burst ahead of the others.
+	vtime float64
+	size  int
+}
+
+type scheduledQueue struct {
+	name      string
+	weight    int
+	pipelines []scheduledPipeline
+	// vtime goes up by 1/weight for each pipeline
+	// started, the queue with the lowest goes next
+	vtime float64
+}
+
+type scheduledPipeline struct {
+	pipeline Pipeline
+	seq      int
+}
+
+func (s *scheduler) Push(pipeline Pipeline) {
+	name := pipelineQueue(pipeline)
+	q, ok := s.queues[name]
+	if !ok {
+		weight := s.weights[name]
+		if weight < 1 {
+			weight = 1
+		}
+		q = &scheduledQueue{name: name, weight: weight}
+		s.queues[name] = q
+	}
+	if len(q.pipelines) == 0 && q.vtime < s.vtime {
+		q.vtime = s.vtime
+	}
+	s.seq++
+	q.pipelines = append(q.pipelines, scheduledPipeline{pipeline: pipeline, seq: s.seq})
+	// keep the highest priority at the front
+	sort.Sort(byPriority(q.pipelines))
+	s.size++
+}
+
+func (s *scheduler) Pop() (Pipeline, bool) {
+	q := nextQueue(s.queueList())
+	if q == nil {
+		return Pipeline{}, false
+	}
+	p := q.pipelines[0].pipeline
+	q.pipelines = q.pipelines[1:]
+	q.vtime += 1 / float64(q.weight)
+	s.vtime = q.vtime
+	if len(q.pipelines) == 0 {
+		delete(s.queues, q.name)
+	}
+	s.size--
+	return p, true
+}
+
+func (s *scheduler) Remove(ID PipelineID) bool {
+	for name, q := range s.queues {
+		for i, p := range q.pipelines {
+			if p.pipeline.ID != ID {
+				continue
+			}
+			q.pipelines = append(q.pipelines[:i], q.pipelines[i+1:]...)
+			if len(q.pipelines) == 0 {
+				delete(s.queues, name)
+			}
+			s.size--
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scheduler) Positions() map[PipelineID]int {
+	positions := make(map[PipelineID]int, s.size)
+	// play out the schedule on copies of the queues
+	var queues []*scheduledQueue
+	for _, q := range s.queueList() {
+		queueCopy := *q
+		queues = append(queues, &queueCopy)
+	}
+	for position := 1; ; position++ {
+		q := nextQueue(queues)
+		if q == nil {
+			return positions
+		}
+		positions[q.pipelines[0].pipeline.ID] = position
+		q.pipelines = q.pipelines[1:]
+		q.vtime += 1 / float64(q.weight)
+	}
+}
+
+func (s *scheduler) Len() int {
+	return s.size
+}
+
+// queueList returns the queues in name order so that ties between
+// them are broken the same way every time
+func (s *scheduler) queueList() []*scheduledQueue {
+	var queues []*scheduledQueue
+	for _, q := range s.queues {
+		queues = append(queues, q)
+	}
+	sort.Sort(byQueueName(queues))
+	return queues
+}
+
+// nextQueue picks the queue whose front pipeline goes next, the one
+// with the highest priority and then the lowest virtual time
+func nextQueue(queues []*scheduledQueue) *scheduledQueue {
+	var next *scheduledQueue
+	for _, q := range queues {
+		if len(q.pipelines) == 0 {
+			continue
+		}
+		if next == nil {
+			next = q
+			continue
+		}
+		priority, nextPriority := q.pipelines[0].pipeline.Priority, next.pipelines[0].pipeline.Priority
+		if priority > nextPriority || (priority == nextPriority && q.vtime < next.vtime) {
+			next = q
+		}
+	}
+	return next
+}
+
+// pipelineQueue returns the name of the queue the pipeline is in
+func pipelineQueue(p Pipeline) string {
+	if p.Queue == "" {
+		return DefaultQueue
+	}
+	return p.Queue
+}
+
+// byPriority sorts pipelines by highest priority and then in order
+type byPriority []scheduledPipeline
+
+func (p byPriority) Len() int      { return len(p) }
+func (p byPriority) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPriority) Less(i, j int) bool {
+	if p[i].pipeline.Priority != p[j].pipeline.Priority {
+		return p[i].pipeline.Priority > p[j].pipeline.Priority
+	}
+	return p[i].seq < p[j].seq
+}
+
+type byQueueName []*scheduledQueue
+
+func (q byQueueName) Len() int           { return len(q) }
+func (q byQueueName) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q byQueueName) Less(i, j int) bool { return q[i].name < q[j].name }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func popAll(s Scheduler) []PipelineID {
+	var IDs []PipelineID
+	for p, ok := s.Pop(); ok; p, ok = s.Pop() {
+		IDs = append(IDs, p.ID)
+	}
+	return IDs
+}
+
+func TestSmallScheduler(t *testing.T) {
+	s := NewScheduler(map[string]int{"release": 2})
+	// a burst from one team shouldn't hold up another
+	for i := 1; i <= 4; i++ {
+		s.Push(Pipeline{ID: PipelineID(i), Queue: "nightly"})
+	}
+	s.Push(Pipeline{ID: 5, Queue: "web"})
+	s.Push(Pipeline{ID: 6, Queue: "web"})
+	// higher priorities go first whatever their queue
+	s.Push(Pipeline{ID: 7, Queue: "nightly", Priority: 10})
+	s.Push(Pipeline{ID: 8, Priority: 5})
+
+	assert.Equal(t, 8, s.Len(), "All pipelines should be waiting")
+	positions := s.Positions()
+	assert.Equal(t, 8, len(positions), "All waiting pipelines should have a position")
+	assert.Equal(t, 1, positions[7], "Highest priority should be first")
+	assert.Equal(t, 4, positions[1], "Queue which was served should wait behind the other")
+	assert.True(t, s.Remove(2), "Waiting pipeline should be removed")
+	assert.False(t, s.Remove(2), "Removed pipeline should not be waiting")
+	assert.Equal(t, 0, s.Positions()[2], "Removed pipeline should have no position")
+	assert.Equal(t, []PipelineID{7, 8, 5, 1, 6, 3, 4}, popAll(s), "Queues should take turns")
+
+	// a weight of 2 gets twice the turns
+	for i := 1; i <= 4; i++ {
+		s.Push(Pipeline{ID: PipelineID(i), Queue: "release"})
+		s.Push(Pipeline{ID: PipelineID(i + 4), Queue: "nightly"})
+	}
+	assert.Equal(t, []PipelineID{5, 1, 2, 6, 3, 4, 7, 8}, popAll(s), "Queues should share by weight")
+
+	// a queue which was idle doesn't get to catch up
+	for i := 1; i <= 3; i++ {
+		s.Push(Pipeline{ID: PipelineID(i), Queue: "nightly"})
+	}
+	s.Pop()
+	s.Pop()
+	s.Push(Pipeline{ID: 4, Queue: "web"})
+	s.Push(Pipeline{ID: 5, Queue: "web"})
+	assert.Equal(t, []PipelineID{3, 4, 5}, popAll(s), "Idle queue should join at the current time")
+}
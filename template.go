@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Template is a named pipeline definition with parameters. Adding a
+// template with the name of an existing one adds a new version of it,
+// the earlier versions are kept and can still be run.
+type Template struct {
+	Name        string `json:"name"`
+	Version     int    `json:"version"`
+	Description string `json:"description,omitempty"`
+	// Parameters are the values given when the template is run
+	Parameters []TemplateParameter `json:"parameters,omitempty"`
+	// Pipeline is the definition of the pipeline. Any string in it may
+	// refer to a parameter as {{name}}. A string which is only a
+	// reference is replaced by the value with its type, so an int
+	// parameter can be used for a field such as priority.
+	Pipeline   json.RawMessage `json:"pipeline"`
+	CreateTime time.Time       `json:"create_time"`
+}
+
+// TemplateParameter is a value given when a template is run
+type TemplateParameter struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Type is string, int or bool, defaults to string
+	Type string `json:"type,omitempty"`
+	// Default is used when no value is given, it must be of the type
+	Default interface{} `json:"default,omitempty"`
+	// Required parameters without a default must be given a value
+	Required bool `json:"required,omitempty"`
+}
+
+// TemplateRun is a request to run a template
+type TemplateRun struct {
+	// Version is the version to run, defaults to the latest
+	Version    int                    `json:"version,omitempty"`
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+// TemplateRef records the template a pipeline was made from
+type TemplateRef struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+	// Parameters are the values of all the parameters,
+	// including those which took their defaults
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+const (
+	// ParameterString is a parameter which is a string
+	ParameterString = "string"
+	// ParameterInt is a parameter which is a whole number
+	ParameterInt = "int"
+	// ParameterBool is a parameter which is true or false
+	ParameterBool = "bool"
+)
+
+// TemplateStore stores the versions of templates
+type TemplateStore interface {
+	// Add adds the template as the next version of its name
+	Add(template Template) (Template, error)
+	// Find returns a version of a template, or the latest if version is 0
+	Find(name string, version int) (Template, error)
+	// Versions returns all the versions of a template, oldest first
+	Versions(name string) ([]Template, error)
+	// List returns the latest version of each template
+	List() ([]Template, error)
+	// Delete removes all the versions of a template. Its version
+	// numbers aren't reused if a template of the name is added again.
+	Delete(name string) error
+}
+
+var (
+	// ErrTemplateNotFound indicates a template or a version of it not found
+	ErrTemplateNotFound = errors.New("Template with that name and version not found")
+)
+
+// NewTemplateStore returns a new TemplateStore
+// which keeps templates in memory only
+func NewTemplateStore() TemplateStore {
+	return &templateStore{
+		lock:   &sync.RWMutex{},
+		data:   make(map[string][]Template),
+		latest: make(map[string]int),
+	}
+}
+
+// NewFileTemplateStore returns a TemplateStore which keeps
+// all the templates in a file, rewritten on every change
+func NewFileTemplateStore(path string) (TemplateStore, error) {
+	store := &templateStore{
+		lock:   &sync.RWMutex{},
+		data:   make(map[string][]Template),
+		latest: make(map[string]int),
+		path:   path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file templateStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for name, version := range file.Latest {
+		store.latest[name] = version
+	}
+	for _, t := range file.Templates {
+		store.data[t.Name] = append(store.data[t.Name], t)
+		if t.Version > store.latest[t.Name] {
+			store.latest[t.Name] = t.Version
+		}
+	}
+	return store, nil
+}
+
+type templateStore struct {
+	lock *sync.RWMutex
+	// data is the versions of each template, oldest first
+	data map[string][]Template
+	// latest is the last version given to each name,
+	// kept after a template is deleted
+	latest map[string]int
+	// path is where the templates are saved, if set
+	path string
+}
+
+// templateStoreFile is the on-disk format of the templates
+type templateStoreFile struct {
+	Templates []Template `json:"templates"`
+	// Latest is the last version given to each name
+	Latest map[string]int `json:"latest,omitempty"`
+}
+
+func (store *templateStore) Add(t Template) (Template, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	versions := store.data[t.Name]
+	latest, named := store.latest[t.Name]
+	t.Version = latest + 1
+	store.data[t.Name] = append(versions, copyTemplate(t))
+	store.latest[t.Name] = t.Version
+	if err := store.save(); err != nil {
+		if len(versions) == 0 {
+			delete(store.data, t.Name)
+		} else {
+			store.data[t.Name] = versions
+		}
+		if named {
+			store.latest[t.Name] = latest
+		} else {
+			delete(store.latest, t.Name)
+		}
+		return Template{}, err
+	}
+	return copyTemplate(t), nil
+}
+
+func (store *templateStore) Find(name string, version int) (Template, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	versions := store.data[name]
+	if len(versions) == 0 {
+		return Template{}, ErrTemplateNotFound
+	}
+	if version == 0 {
+		return copyTemplate(versions[len(versions)-1]), nil
+	}
+	for _, t := range versions {
+		if t.Version == version {
+			return copyTemplate(t), nil
+		}
+	}
+	return Template{}, ErrTemplateNotFound
+}
+
+func (store *templateStore) Versions(name string) ([]Template, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	versions := store.data[name]
+	if len(versions) == 0 {
+		return nil, ErrTemplateNotFound
+	}
+	templates := make([]Template, len(versions))
+	for i, t := range versions {
+		templates[i] = copyTemplate(t)
+	}
+	return templates, nil
+}
+
+func (store *templateStore) List() ([]Template, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	var templates []Template
+	for _, versions := range store.data {
+		templates = append(templates, copyTemplate(versions[len(versions)-1]))
+	}
+	sort.Sort(byTemplate(templates))
+	return templates, nil
+}
+
+func (store *templateStore) Delete(name string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	versions, ok := store.data[name]
+	if !ok {
+		return ErrTemplateNotFound
+	}
+	delete(store.data, name)
+	if err := store.save(); err != nil {
+		store.data[name] = versions
+		return err
+	}
+	return nil
+}
+
+// save writes the templates to the file if there is
+// one, it must be called with the lock held
+func (store *templateStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	file := templateStoreFile{Latest: store.latest}
+	for _, versions := range store.data {
+		file.Templates = append(file.Templates, versions...)
+	}
+	sort.Sort(byTemplate(file.Templates))
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(store.path, data)
+}
+
+// copyTemplate returns the template with copies of the parts
+// which are shared, so changing one doesn't change the other
+func copyTemplate(t Template) Template {
+	t.Parameters = append([]TemplateParameter(nil), t.Parameters...)
+	t.Pipeline = append(json.RawMessage(nil), t.Pipeline...)
+	return t
+}
+
+type byTemplate []Template
+
+func (t byTemplate) Len() int      { return len(t) }
+func (t byTemplate) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byTemplate) Less(i, j int) bool {
+	if t[i].Name != t[j].Name {
+		return t[i].Name < t[j].Name
+	}
+	return t[i].Version < t[j].Version
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/emicklei/go-restful"
+)
+
+// TemplateAPI is the Template management API
+type TemplateAPI struct {
+	templateService TemplateService
+}
+
+// NewTemplateAPI returns a new TemplateAPI
+func NewTemplateAPI(templateService TemplateService) TemplateAPI {
+	return TemplateAPI{
+		templateService: templateService,
+	}
+}
+
+// Register adds the routes to the web service container
+func (api TemplateAPI) Register(container *restful.Container) {
+	ws := new(restful.WebService)
+
+	ws.Path("/templates").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	ws.Route(ws.GET("").To(api.listTemplates).
+		Operation("listTemplates").
+		Writes([]Template{}))
+
+	ws.Route(ws.POST("").To(api.createTemplate).
+		Operation("createTemplate").
+		Reads(Template{}).
+		Writes(Template{}))
+
+	ws.Route(ws.GET("/{name}").To(api.findTemplate).
+		Operation("findTemplate").
+		Param(ws.PathParameter("name", "name of template").DataType("string")).
+		Writes(Template{}))
+
+	ws.Route(ws.DELETE("/{name}").To(api.deleteTemplate).
+		Operation("deleteTemplate").
+		Param(ws.PathParameter("name", "name of template").DataType("string")))
+
+	ws.Route(ws.GET("/{name}/versions").To(api.listTemplateVersions).
+		Operation("listTemplateVersions").
+		Param(ws.PathParameter("name", "name of template").DataType("string")).
+		Writes([]Template{}))
+
+	ws.Route(ws.GET("/{name}/versions/{version}").To(api.findTemplateVersion).
+		Operation("findTemplateVersion").
+		Param(ws.PathParameter("name", "name of template").DataType("string")).
+		Param(ws.PathParameter("version", "version of template").DataType("int")).
+		Writes(Template{}))
+
+	ws.Route(ws.POST("/{name}/run").To(api.runTemplate).
+		Operation("runTemplate").
+		Param(ws.PathParameter("name", "name of template").DataType("string")).
+		Reads(TemplateRun{}).
+		Writes(Pipeline{}))
+
+	container.Add(ws)
+}
+
+func (api TemplateAPI) listTemplates(request *restful.Request, response *restful.Response) {
+	templates, err := api.templateService.List()
+	if err != nil {
+		logAndRespondError(response, http.StatusInternalServerError, err)
+		return
+	}
+	if templates == nil {
+		templates = []Template{}
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, templates)
+}
+
+func (api TemplateAPI) createTemplate(request *restful.Request, response *restful.Response) {
+	template := &Template{}
+	if err := request.ReadEntity(template); err != nil {
+		logAndRespondError(response, http.StatusBadRequest, err)
+		return
+	}
+	t, err := api.templateService.Add(*template)
+	if err != nil {
+		respondTemplateError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusCreated, t)
+}
+
+func (api TemplateAPI) findTemplate(request *restful.Request, response *restful.Response) {
+	t, err := api.templateService.Find(request.PathParameter("name"), 0)
+	if err != nil {
+		respondTemplateError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, t)
+}
+
+func (api TemplateAPI) deleteTemplate(request *restful.Request, response *restful.Response) {
+	if err := api.templateService.Delete(request.PathParameter("name")); err != nil {
+		respondTemplateError(response, err)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (api TemplateAPI) listTemplateVersions(request *restful.Request, response *restful.Response) {
+	templates, err := api.templateService.Versions(request.PathParameter("name"))
+	if err != nil {
+		respondTemplateError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, templates)
+}
+
+func (api TemplateAPI) findTemplateVersion(request *restful.Request, response *restful.Response) {
+	version, err := strconv.Atoi(request.PathParameter("version"))
+	if err != nil || version < 1 {
+		response.WriteHeaderAndEntity(http.StatusNotFound, errorResponse("Version must be a positive int"))
+		return
+	}
+	t, err := api.templateService.Find(request.PathParameter("name"), version)
+	if err != nil {
+		respondTemplateError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusOK, t)
+}
+
+func (api TemplateAPI) runTemplate(request *restful.Request, response *restful.Response) {
+	run := &TemplateRun{}
+	// a template whose parameters all have defaults can be run without a body
+	if request.Request.ContentLength != 0 {
+		if err := request.ReadEntity(run); err != nil {
+			logAndRespondError(response, http.StatusBadRequest, err)
+			return
+		}
+	}
+	p, err := api.templateService.Run(request.PathParameter("name"), *run)
+	if err != nil {
+		respondTemplateError(response, err)
+		return
+	}
+	response.WriteHeaderAndEntity(http.StatusCreated, p)
+}
+
+func respondTemplateError(response *restful.Response, err error) {
+	switch {
+	case err == ErrTemplateNotFound:
+		logAndRespondError(response, http.StatusNotFound, err)
+	case isValidationError(err):
+		logAndRespondError(response, http.StatusBadRequest, err)
+	case err == ErrShuttingDown:
+		logAndRespondError(response, http.StatusServiceUnavailable, err)
+	default:
+		logAndRespondError(response, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// templateReference matches a reference to a parameter in a template
+var templateReference = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// TemplateService manages Templates and
+// runs the pipelines made from them
+type TemplateService interface {
+	// Add adds the template as the next version of its name
+	Add(template Template) (Template, error)
+	// Find returns a version of a template, or the latest if version is 0
+	Find(name string, version int) (Template, error)
+	Versions(name string) ([]Template, error)
+	List() ([]Template, error)
+	Delete(name string) error
+	// Run renders a pipeline from the template with
+	// the parameter values given and submits it
+	Run(name string, run TemplateRun) (Pipeline, error)
+}
+
+// NewTemplateService returns a new TemplateService which
+// submits the pipelines it renders to pipelineService
+func NewTemplateService(templateStore TemplateStore, pipelineService PipelineService) TemplateService {
+	return templateService{
+		templateStore:   templateStore,
+		pipelineService: pipelineService,
+	}
+}
+
+type templateService struct {
+	templateStore   TemplateStore
+	pipelineService PipelineService
+}
+
+func (service templateService) Add(template Template) (Template, error) {
+	setTemplateDefaults(&template)
+	if err := ValidateTemplate(template); err != nil {
+		return Template{}, err
+	}
+	template.CreateTime = time.Now()
+	t, err := service.templateStore.Add(template)
+	if err != nil {
+		return Template{}, err
+	}
+	log.Infof("Added template %s version %d", t.Name, t.Version)
+	return t, nil
+}
+
+func (service templateService) Find(name string, version int) (Template, error) {
+	return service.templateStore.Find(name, version)
+}
+
+func (service templateService) Versions(name string) ([]Template, error) {
+	return service.templateStore.Versions(name)
+}
+
+func (service templateService) List() ([]Template, error) {
+	return service.templateStore.List()
+}
+
+func (service templateService) Delete(name string) error {
+	return service.templateStore.Delete(name)
+}
+
+func (service templateService) Run(name string, run TemplateRun) (Pipeline, error) {
+	t, err := service.templateStore.Find(name, run.Version)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	values, err := templateValues(t, run.Parameters)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	pipeline, err := renderTemplate(t, values)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	pipeline.Template = &TemplateRef{
+		Name:       t.Name,
+		Version:    t.Version,
+		Parameters: values,
+	}
+	// adding the pipeline validates it
+	p, err := service.pipelineService.Add(pipeline)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	log.Infof("Ran template %s version %d as pipeline %d", t.Name, t.Version, p.ID)
+	return p, nil
+}
+
+// templateValues returns the value of every parameter of the
+// template, from the values given or the parameters' defaults
+func templateValues(t Template, given map[string]interface{}) (map[string]interface{}, error) {
+	for name := range given {
+		if _, ok := findTemplateParameter(t, name); !ok {
+			return nil, ValidationError{ErrUnknownTemplateParameter}
+		}
+	}
+	values := make(map[string]interface{})
+	for _, param := range t.Parameters {
+		v, ok := given[param.Name]
+		if !ok || v == nil {
+			v = param.Default
+		}
+		if v == nil {
+			if param.Required {
+				return nil, ValidationError{ErrMissingTemplateParameter}
+			}
+			v = parameterZero(param.Type)
+		}
+		value, ok := parameterValue(param.Type, v)
+		if !ok {
+			return nil, ValidationError{ErrInvalidTemplateParameterValue}
+		}
+		values[param.Name] = value
+	}
+	return values, nil
+}
+
+// renderTemplate replaces the references to parameters in the
+// template's pipeline definition with their values
+func renderTemplate(t Template, values map[string]interface{}) (Pipeline, error) {
+	definition, err := decodeTemplatePipeline(t)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	rendered := mapTemplateStrings(definition, func(s string) interface{} {
+		// a string which is only a reference takes the value's type
+		if match := templateReference.FindStringSubmatchIndex(s); match != nil &&
+			match[0] == 0 && match[1] == len(s) {
+			return values[s[match[2]:match[3]]]
+		}
+		return templateReference.ReplaceAllStringFunc(s, func(ref string) string {
+			name := templateReference.FindStringSubmatch(ref)[1]
+			return fmt.Sprint(values[name])
+		})
+	})
+	data, err := json.Marshal(rendered)
+	if err != nil {
+		return Pipeline{}, err
+	}
+	var pipeline Pipeline
+	if err := json.Unmarshal(data, &pipeline); err != nil {
+		return Pipeline{}, ValidationError{ErrInvalidTemplatePipeline}
+	}
+	return pipeline, nil
+}
+
+// templateReferences returns the names of the
+// parameters the template's pipeline refers to
+func templateReferences(t Template) ([]string, error) {
+	definition, err := decodeTemplatePipeline(t)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	mapTemplateStrings(definition, func(s string) interface{} {
+		for _, match := range templateReference.FindAllStringSubmatch(s, -1) {
+			names = append(names, match[1])
+		}
+		return s
+	})
+	return names, nil
+}
+
+// decodeTemplatePipeline decodes the template's pipeline definition,
+// keeping numbers as they were written
+func decodeTemplatePipeline(t Template) (map[string]interface{}, error) {
+	var definition map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(t.Pipeline))
+	decoder.UseNumber()
+	if err := decoder.Decode(&definition); err != nil || definition == nil {
+		return nil, ValidationError{ErrInvalidTemplatePipeline}
+	}
+	return definition, nil
+}
+
+// mapTemplateStrings returns the decoded JSON value with
+// each string in it replaced by the result of f
+func mapTemplateStrings(v interface{}, f func(string) interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return f(v)
+	case []interface{}:
+		mapped := make([]interface{}, len(v))
+		for i, item := range v {
+			mapped[i] = mapTemplateStrings(item, f)
+		}
+		return mapped
+	case map[string]interface{}:
+		mapped := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			mapped[key] = mapTemplateStrings(item, f)
+		}
+		return mapped
+	default:
+		return v
+	}
+}
+
+// parameterValue converts v to the parameter type, as it's decoded
+// from JSON, returning false if it isn't a value of the type
+func parameterValue(paramType string, v interface{}) (interface{}, bool) {
+	switch paramType {
+	case ParameterString:
+		s, ok := v.(string)
+		return s, ok
+	case ParameterInt:
+		switch n := v.(type) {
+		case int:
+			return int64(n), true
+		case int64:
+			return n, true
+		case float64:
+			if n != math.Trunc(n) || math.Abs(n) > 1<<53 {
+				return nil, false
+			}
+			return int64(n), true
+		case json.Number:
+			i, err := n.Int64()
+			return i, err == nil
+		}
+		return nil, false
+	case ParameterBool:
+		b, ok := v.(bool)
+		return b, ok
+	}
+	return nil, false
+}
+
+// parameterZero is the value of an optional
+// parameter with no default which isn't given
+func parameterZero(paramType string) interface{} {
+	switch paramType {
+	case ParameterInt:
+		return int64(0)
+	case ParameterBool:
+		return false
+	}
+	return ""
+}
+
+func findTemplateParameter(t Template, name string) (TemplateParameter, bool) {
+	for _, param := range t.Parameters {
+		if param.Name == name {
+			return param, true
+		}
+	}
+	return TemplateParameter{}, false
+}
+
+func setTemplateDefaults(t *Template) {
+	for i := range t.Parameters {
+		if t.Parameters[i].Type == "" {
+			t.Parameters[i].Type = ParameterString
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallTemplateService(t *testing.T) {
+	pipelines := &fakePipelineService{}
+	service := NewTemplateService(NewTemplateStore(), pipelines)
+	template := Template{
+		Name: "build",
+		Parameters: []TemplateParameter{
+			{Name: "image", Required: true},
+			{Name: "tag", Default: "latest"},
+			{Name: "priority", Type: ParameterInt, Default: float64(1)},
+			{Name: "verbose", Type: ParameterBool},
+		},
+		Pipeline: json.RawMessage(`{
+			"name": "Build {{image}}",
+			"priority": "{{ priority }}",
+			"steps": [{"name": "build", "image": "{{image}}:{{tag}}", "cmds": ["make VERBOSE={{verbose}}"]}]
+		}`),
+	}
+
+	v1, err := service.Add(template)
+	if !assert.Nil(t, err, "Template should be added") {
+		return
+	}
+	assert.Equal(t, 1, v1.Version, "First version should be 1")
+	assert.Equal(t, ParameterString, v1.Parameters[0].Type, "Type should default to string")
+	template.Pipeline = json.RawMessage(`{"name": "Build {{image}} v2", "steps": [{"name": "build", "image": "{{image}}:{{tag}}", "cmds": ["make"]}]}`)
+	v2, err := service.Add(template)
+	assert.Nil(t, err, "Second version should be added")
+	assert.Equal(t, 2, v2.Version, "Second version should be 2")
+
+	p, err := service.Run("build", TemplateRun{Version: 1, Parameters: map[string]interface{}{
+		"image":    "golang",
+		"priority": float64(3),
+	}})
+	if assert.Nil(t, err, "Template should run") {
+		assert.Equal(t, "Build golang", p.Name, "Parameters should be filled in")
+		assert.Equal(t, 3, p.Priority, "A lone reference should keep its type")
+		assert.Equal(t, "golang:latest", p.Steps[0].ImageName, "Defaults should be filled in")
+		assert.Equal(t, Cmd("make VERBOSE=false"), p.Steps[0].Cmds[0], "Optional parameters should be zero")
+		assert.Equal(t, &TemplateRef{Name: "build", Version: 1, Parameters: map[string]interface{}{
+			"image": "golang", "tag": "latest", "priority": int64(3), "verbose": false,
+		}}, p.Template, "Pipeline should record the template")
+	}
+	p, err = service.Run("build", TemplateRun{Parameters: map[string]interface{}{"image": "golang"}})
+	if assert.Nil(t, err, "Latest version should run") {
+		assert.Equal(t, "Build golang v2", p.Name, "Latest version should be run")
+		assert.Equal(t, 2, p.Template.Version, "Pipeline should record the version")
+	}
+
+	runErrors := []struct {
+		name   string
+		values map[string]interface{}
+		err    error
+	}{
+		{"build", nil, ValidationError{ErrMissingTemplateParameter}},
+		{"build", map[string]interface{}{"image": "golang", "colour": "red"}, ValidationError{ErrUnknownTemplateParameter}},
+		{"build", map[string]interface{}{"image": "golang", "priority": 1.5}, ValidationError{ErrInvalidTemplateParameterValue}},
+		{"build", map[string]interface{}{"image": "golang", "verbose": "yes"}, ValidationError{ErrInvalidTemplateParameterValue}},
+		{"build", map[string]interface{}{"image": "golang", "priority": "high"}, ValidationError{ErrInvalidTemplateParameterValue}},
+		{"deploy", nil, ErrTemplateNotFound},
+	}
+	for _, c := range runErrors {
+		_, err := service.Run(c.name, TemplateRun{Parameters: c.values})
+		assert.Equal(t, c.err, err, "Run of %s with %v should fail", c.name, c.values)
+	}
+	// the rendered pipeline is validated
+	_, err = service.Add(Template{
+		Name:       "test",
+		Parameters: []TemplateParameter{{Name: "image"}},
+		Pipeline:   json.RawMessage(`{"name": "Test", "steps": [{"name": "test", "image": "{{image}}", "cmds": ["make test"]}]}`),
+	})
+	assert.Nil(t, err, "Template should be added")
+	_, err = service.Run("test", TemplateRun{})
+	assert.Equal(t, ValidationError{ErrMissingImageName}, err, "Rendered pipeline should be validated")
+	assert.Equal(t, 2, len(pipelines.pipelines), "Only valid pipelines should be submitted")
+
+	addErrors := []struct {
+		template Template
+		err      error
+	}{
+		{Template{Name: "a/b", Pipeline: json.RawMessage(`{}`)}, ValidationError{ErrInvalidTemplateName}},
+		{Template{Name: "a", Pipeline: json.RawMessage(`[]`)}, ValidationError{ErrInvalidTemplatePipeline}},
+		{Template{Name: "a", Pipeline: json.RawMessage(`{"name": "{{missing}}"}`)}, ValidationError{ErrUndefinedTemplateParameter}},
+		{Template{Name: "a", Pipeline: json.RawMessage(`{}`), Parameters: []TemplateParameter{{Name: "n", Type: ParameterInt, Default: "one"}}}, ValidationError{ErrInvalidTemplateParameter}},
+		{Template{Name: "a", Pipeline: json.RawMessage(`{}`), Parameters: []TemplateParameter{{Name: "n"}, {Name: "n"}}}, ValidationError{ErrInvalidTemplateParameter}},
+		{Template{Name: "a", Pipeline: json.RawMessage(`{}`), Parameters: []TemplateParameter{{Name: "n", Type: "float"}}}, ValidationError{ErrInvalidTemplateParameter}},
+	}
+	for i, c := range addErrors {
+		_, err := service.Add(c.template)
+		assert.Equal(t, c.err, err, "Template %d should be rejected", i)
+	}
+
+	versions, err := service.Versions("build")
+	assert.Nil(t, err, "Versions should be found")
+	assert.Equal(t, 2, len(versions), "Both versions should be kept")
+	assert.Nil(t, service.Delete("build"), "Template should be deleted")
+	_, err = service.Find("build", 0)
+	assert.Equal(t, ErrTemplateNotFound, err, "Deleted template should not be found")
+
+	// pipelines made from the deleted versions still refer to them
+	readded, err := service.Add(template)
+	assert.Nil(t, err, "Deleted template should be added again")
+	assert.Equal(t, 3, readded.Version, "Deleted versions should not be reused")
+}
+
+func TestSmallFileTemplateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if !assert.Nil(t, err, "Temp dir should be created") {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "templates.json")
+
+	store, err := NewFileTemplateStore(path)
+	assert.Nil(t, err, "Store should be created")
+	template := Template{Name: "build", Pipeline: json.RawMessage(`{}`)}
+	for i := 0; i < 2; i++ {
+		_, err = store.Add(template)
+		assert.Nil(t, err, "Template should be added")
+	}
+	assert.Nil(t, store.Delete("build"), "Template should be deleted")
+
+	store, err = NewFileTemplateStore(path)
+	assert.Nil(t, err, "Store should be reopened")
+	_, err = store.Find("build", 0)
+	assert.Equal(t, ErrTemplateNotFound, err, "Deleted template should stay deleted")
+	readded, err := store.Add(template)
+	assert.Nil(t, err, "Template should be added again")
+	assert.Equal(t, 3, readded.Version, "Deleted versions should not be reused after reopening")
+}
@@ -8,6 +8,6 @@ echo "Running tests"
 host=$(echo $DOCKER_HOST | awk -F/ '{print $3}' | awk -F: '{print $1}')
 port=$(docker-compose port pipeline 4322 | awk -F: {'print $2'})
 export PIPELINE_URL="http://$host:$port"
-go test
+go test -tags large
 docker-compose -f test.yml -p test_run kill
 docker-compose -f test.yml -p test_run rm  -f
@@ -4,24 +4,57 @@ import log "github.com/Sirupsen/logrus"
 
 // Updater handles updating pipelines and steps
 type Updater interface {
+	AddPipeline(pipeline Pipeline) (Pipeline, error)
 	UpdatePipeline(pipeline Pipeline) error
 }
 
 // NewUpdater returns a new Updater
-func NewUpdater(pipelineStore PipelineStore) Updater {
+func NewUpdater(pipelineStore PipelineStore, events EventBroker, notifier Notifier) Updater {
 	return updater{
 		pipelineStore: pipelineStore,
+		events:        events,
+		notifier:      notifier,
 	}
 }
 
 type updater struct {
 	pipelineStore PipelineStore
+	events        EventBroker
+	notifier      Notifier
+}
+
+func (u updater) AddPipeline(p Pipeline) (Pipeline, error) {
+	p, err := u.pipelineStore.Add(p)
+	if err != nil {
+		log.Errorf("Error adding pipeline: %s", err)
+		return Pipeline{}, err
+	}
+	u.publish(p, Event{
+		Type:       EventPipelineQueued,
+		PipelineID: p.ID,
+		Status:     p.Status,
+	})
+	return p, nil
 }
 
 func (u updater) UpdatePipeline(p Pipeline) error {
+	old, err := u.pipelineStore.Find(p.ID)
+	if err != nil {
+		log.Errorf("Error finding pipeline %d to update: %s", p.ID, err)
+		return err
+	}
 	if err := u.pipelineStore.Update(p); err != nil {
 		log.Errorf("Error updating pipeline status %d: %s", p.ID, err)
 		return err
 	}
+	// publish what changed as events
+	u.publish(p, pipelineEvents(old, p)...)
 	return nil
 }
+
+func (u updater) publish(p Pipeline, events ...Event) {
+	for _, event := range events {
+		event = u.events.Publish(event)
+		u.notifier.Notify(p, event)
+	}
+}
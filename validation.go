@@ -1,6 +1,11 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+)
 
 var (
 	// ErrMissingPipelineName indicates a pipeline name is missing
@@ -15,10 +20,50 @@ var (
 	ErrMissingImageName = fmt.Errorf("Must specify an image name")
 	// ErrMissingCommands indicates a step name is missing
 	ErrMissingCommands = fmt.Errorf("Must specify a command or list of commands")
+	// ErrUnterminatedQuote indicates a command has a quote or escape which isn't closed
+	ErrUnterminatedQuote = fmt.Errorf("Commands must not have an unterminated quote or a trailing backslash")
 	// ErrNonExistentStepDependency indicates a step name is missing
 	ErrNonExistentStepDependency = fmt.Errorf("All step dependencies must exist")
 	// ErrCircularStepDependency indicates a step name is missing
 	ErrCircularStepDependency = fmt.Errorf("Must have no circular dependencies between steps")
+	// ErrInvalidRetry indicates a step's retry policy is invalid
+	ErrInvalidRetry = fmt.Errorf("Retry must have at least 1 max attempt, no negative backoff and only retry on failed, error or timed-out")
+	// ErrNegativeTimeout indicates a pipeline or step timeout is negative
+	ErrNegativeTimeout = fmt.Errorf("Timeouts must not be negative")
+	// ErrInvalidWhen indicates a step's when condition can't be parsed
+	ErrInvalidWhen = fmt.Errorf("When must be on_success, on_failure, always or a valid condition")
+	// ErrWhenNotDependency indicates a when condition refers to a step which isn't a dependency
+	ErrWhenNotDependency = fmt.Errorf("When conditions may only refer to the status of steps in after")
+	// ErrInvalidNotification indicates a notification has a bad URL or unknown event
+	ErrInvalidNotification = fmt.Errorf("Notifications must have an http or https URL and only known event types")
+	// ErrUnknownRunner indicates a step's runner isn't one of the configured executors
+	ErrUnknownRunner = fmt.Errorf("Runner must be one of the enabled runners")
+	// ErrNonUniqueMatrixNames indicates not all the instances of a matrix step have unique names
+	ErrNonUniqueMatrixNames = fmt.Errorf("All matrix instance names of a step must be unique")
+	// ErrMissingScheduleName indicates a schedule name is missing
+	ErrMissingScheduleName = fmt.Errorf("Must specify a schedule name")
+	// ErrInvalidCron indicates a schedule's cron expression can't be parsed or never matches
+	ErrInvalidCron = fmt.Errorf("Cron must be a five field cron expression which matches some time")
+	// ErrInvalidTimezone indicates a schedule's timezone is unknown
+	ErrInvalidTimezone = fmt.Errorf("Timezone must be an IANA time zone name such as Europe/London")
+	// ErrInvalidSchedulePolicy indicates a schedule has an unknown overlap or catch up policy
+	ErrInvalidSchedulePolicy = fmt.Errorf("Overlap must be skip, queue or cancel_previous and catch up must be none, last or all")
+	// ErrInvalidVarName indicates a pipeline var's name isn't valid
+	ErrInvalidVarName = fmt.Errorf("Var names must be letters, numbers and underscores, not starting with a number")
+	// ErrInvalidTemplateName indicates a template name is missing or can't be used in a URL
+	ErrInvalidTemplateName = fmt.Errorf("Template name must be letters, numbers, dots, dashes and underscores")
+	// ErrInvalidTemplatePipeline indicates a template's pipeline isn't a pipeline definition
+	ErrInvalidTemplatePipeline = fmt.Errorf("Template pipeline must be a JSON object which is a pipeline once its parameters are filled in")
+	// ErrInvalidTemplateParameter indicates a template parameter is badly declared
+	ErrInvalidTemplateParameter = fmt.Errorf("Template parameters must have unique names and a type of string, int or bool, with a default of that type")
+	// ErrUndefinedTemplateParameter indicates a template's pipeline refers to a parameter which isn't declared
+	ErrUndefinedTemplateParameter = fmt.Errorf("Template pipeline may only refer to declared parameters")
+	// ErrUnknownTemplateParameter indicates a value was given for a parameter the template doesn't have
+	ErrUnknownTemplateParameter = fmt.Errorf("Values may only be given for the template's parameters")
+	// ErrMissingTemplateParameter indicates no value was given for a required parameter
+	ErrMissingTemplateParameter = fmt.Errorf("Must give a value for every required parameter without a default")
+	// ErrInvalidTemplateParameterValue indicates a parameter value isn't of the parameter's type
+	ErrInvalidTemplateParameterValue = fmt.Errorf("Parameter values must be of the parameter's type")
 )
 
 // ValidationError represents a pipeline validation error
@@ -40,6 +85,70 @@ func ValidatePipeline(pipeline Pipeline) error {
 	return runValidations(pipeline)
 }
 
+// ValidateSchedule checks that a schedule is valid,
+// including the pipeline it submits
+func ValidateSchedule(schedule Schedule) error {
+	if schedule.Name == "" {
+		return ValidationError{ErrMissingScheduleName}
+	}
+	if _, err := time.LoadLocation(schedule.Timezone); err != nil {
+		return ValidationError{ErrInvalidTimezone}
+	}
+	if nextScheduleRun(schedule, time.Now()).IsZero() {
+		return ValidationError{ErrInvalidCron}
+	}
+	switch schedule.Overlap {
+	case OverlapSkip, OverlapQueue, OverlapCancelPrevious:
+	default:
+		return ValidationError{ErrInvalidSchedulePolicy}
+	}
+	switch schedule.CatchUp {
+	case CatchUpNone, CatchUpLast, CatchUpAll:
+	default:
+		return ValidationError{ErrInvalidSchedulePolicy}
+	}
+	return ValidatePipeline(schedule.Pipeline)
+}
+
+var (
+	templateNamePattern      = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	templateParameterPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ValidateTemplate checks that a template is valid. The pipeline
+// can only be validated once it's rendered, so that is only
+// checked to refer to the template's parameters.
+func ValidateTemplate(template Template) error {
+	if !templateNamePattern.MatchString(template.Name) {
+		return ValidationError{ErrInvalidTemplateName}
+	}
+	names := make(map[string]bool)
+	for _, param := range template.Parameters {
+		if !templateParameterPattern.MatchString(param.Name) || names[param.Name] {
+			return ValidationError{ErrInvalidTemplateParameter}
+		}
+		names[param.Name] = true
+		if param.Type != ParameterString && param.Type != ParameterInt && param.Type != ParameterBool {
+			return ValidationError{ErrInvalidTemplateParameter}
+		}
+		if param.Default != nil {
+			if _, ok := parameterValue(param.Type, param.Default); !ok {
+				return ValidationError{ErrInvalidTemplateParameter}
+			}
+		}
+	}
+	refs, err := templateReferences(template)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if !names[ref] {
+			return ValidationError{ErrUndefinedTemplateParameter}
+		}
+	}
+	return nil
+}
+
 func runValidations(pipeline Pipeline) error {
 	for _, v := range validations {
 		if err := v(pipeline); err != nil {
@@ -74,9 +183,19 @@ var validations = []validation{
 	},
 	func(pipeline Pipeline) error {
 		for _, step := range pipeline.Steps {
-			if step.ImageName == "" {
+			// local steps run on the host rather than in an image
+			if step.ImageName != "" || step.Runner == RunnerLocal {
+				continue
+			}
+			// every instance of a matrix step may set its own image
+			if len(step.Matrix) == 0 {
 				return ErrMissingImageName
 			}
+			for _, instance := range step.Matrix {
+				if instance.ImageName == "" {
+					return ErrMissingImageName
+				}
+			}
 		}
 		return nil
 	},
@@ -88,13 +207,72 @@ var validations = []validation{
 			// return error if any Cmds were specified
 			// as blank
 			for _, cmd := range step.Cmds {
-				if cmd == "" {
+				args, err := splitCommand(string(cmd))
+				if err != nil {
+					return ErrUnterminatedQuote
+				}
+				if len(args) == 0 {
 					return ErrMissingCommands
 				}
 			}
 		}
 		return nil
 	},
+	func(pipeline Pipeline) error {
+		if pipeline.Timeout < 0 {
+			return ErrNegativeTimeout
+		}
+		for _, step := range pipeline.Steps {
+			if step.Timeout < 0 {
+				return ErrNegativeTimeout
+			}
+		}
+		return nil
+	},
+	func(pipeline Pipeline) error {
+		for _, step := range pipeline.Steps {
+			if step.Retry == nil {
+				continue
+			}
+			if step.Retry.MaxAttempts < 1 || step.Retry.Backoff < 0 ||
+				step.Retry.MaxBackoff < 0 || step.Retry.Multiplier < 0 {
+				return ErrInvalidRetry
+			}
+			for _, status := range step.Retry.On {
+				if status != StatusFailed && status != StatusError && status != StatusTimedOut {
+					return ErrInvalidRetry
+				}
+			}
+		}
+		return nil
+	},
+	func(pipeline Pipeline) error {
+		for _, notification := range pipeline.Notifications {
+			u, err := url.Parse(notification.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return ErrInvalidNotification
+			}
+			for _, eventType := range notification.Events {
+				if !containsEventType(eventTypes, eventType) {
+					return ErrInvalidNotification
+				}
+			}
+		}
+		return nil
+	},
+	func(pipeline Pipeline) error {
+		for _, step := range pipeline.Steps {
+			instances := make(map[string]bool)
+			for i := range step.Matrix {
+				name := matrixInstanceName(*step, i)
+				if instances[name] {
+					return ErrNonUniqueMatrixNames
+				}
+				instances[name] = true
+			}
+		}
+		return nil
+	},
 	func(pipeline Pipeline) error {
 		steps := make(map[string]bool)
 		for _, step := range pipeline.Steps {
@@ -103,6 +281,14 @@ var validations = []validation{
 			}
 			steps[step.Name] = true
 		}
+		// the names of matrix instances must not clash with other steps
+		expanded := make(map[string]bool)
+		for _, step := range expandMatrix(pipeline).Steps {
+			if expanded[step.Name] {
+				return ErrNonUniqueStepNames
+			}
+			expanded[step.Name] = true
+		}
 		// now validate that all the After references
 		// are to other steps
 		for _, step := range pipeline.Steps {
@@ -114,6 +300,37 @@ var validations = []validation{
 		}
 		return nil
 	},
+	func(pipeline Pipeline) error {
+		// the steps of a rerun are already expanded, depending
+		// on the instances of a matrix step depends on it
+		matrixOf := make(map[string]string)
+		for _, step := range pipeline.Steps {
+			if step.MatrixOf != "" {
+				matrixOf[step.Name] = step.MatrixOf
+			}
+		}
+		for _, step := range pipeline.Steps {
+			if isOnSuccess(step.When) {
+				continue
+			}
+			_, refs, err := parseCondition(step.When)
+			if err != nil {
+				return ErrInvalidWhen
+			}
+			deps := append([]string(nil), step.After...)
+			for _, dep := range step.After {
+				if parent, ok := matrixOf[dep]; ok {
+					deps = append(deps, parent)
+				}
+			}
+			for _, ref := range refs.steps {
+				if !containsString(deps, ref) {
+					return ErrWhenNotDependency
+				}
+			}
+		}
+		return nil
+	},
 	func(pipeline Pipeline) error {
 		steps := make(map[string]Step)
 		for _, step := range pipeline.Steps {
@@ -148,6 +365,16 @@ var validations = []validation{
 		}
 		return nil
 	},
+	validateVars,
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
 
 func cycleFind(state *cycleFindState, curr string) {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -450,4 +451,331 @@ var validationTestCases = []validationTestCase{
 			},
 		},
 	},
+	validationTestCase{
+		err: ValidationError{ErrInvalidRetry},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					Retry:     &RetryPolicy{MaxAttempts: 0},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrInvalidRetry},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					Retry:     &RetryPolicy{MaxAttempts: 3, On: []Status{StatusStopped}},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: nil,
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					Retry: &RetryPolicy{
+						MaxAttempts: 3,
+						Backoff:     Duration(time.Second),
+						On:          []Status{StatusFailed, StatusError},
+					},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrNegativeTimeout},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					Timeout:   Duration(-time.Second),
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrInvalidWhen},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					When:      `status("Test Step 2") ==`,
+					After:     []string{"Test Step 2"},
+				},
+				&Step{
+					Name:      "Test Step 2",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrWhenNotDependency},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					When:      `status("Test Step 2") == "failed"`,
+				},
+				&Step{
+					Name:      "Test Step 2",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: nil,
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					When:      `failure() && (status("Test Step 2") != 'successful' || pipeline.name == "x")`,
+					After:     []string{"Test Step 2"},
+				},
+				&Step{
+					Name:      "Test Step 2",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					When:      WhenAlways,
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrNonUniqueMatrixNames},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					Matrix:    []MatrixInstance{{Name: "a"}, {Name: "a"}},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrNonUniqueStepNames},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "test",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+					Matrix:    []MatrixInstance{{Name: "a"}, {Name: "b"}},
+				},
+				&Step{
+					Name:      "test[a]",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrMissingImageName},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:   "test",
+					Cmds:   []Cmd{"cmd1"},
+					Matrix: []MatrixInstance{{ImageName: "golang:1.6"}, {}},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrInvalidNotification},
+		pipeline: Pipeline{
+			Name:          "Test Pipeline",
+			Notifications: []Notification{{URL: "ftp://example.com/hook"}},
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrInvalidNotification},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Notifications: []Notification{{
+				URL:    "https://example.com/hook",
+				Events: []EventType{"pipeline.exploded"},
+			}},
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"cmd1"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: nil,
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:   "Test Step 1",
+					Runner: RunnerLocal,
+					Cmds:   []Cmd{"cmd1"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrUnterminatedQuote},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{`bash -c "echo hi`},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrMissingCommands},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"  "},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: nil,
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Vars: map[string]string{"tag": "0.0.1"},
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "pipeline-build:${tag}",
+					Cmds:      []Cmd{"echo ${pipeline.id} ${pipeline.name} ${step.name} ${run.time} $${HOME}"},
+					Env:       map[string]string{"TAG": "${tag}"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{ErrInvalidVarName},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Vars: map[string]string{"image-tag": "0.0.1"},
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"ls"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{VarReferenceError{Step: "Test Step 1", Field: "env TAG", Var: "version"}},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Vars: map[string]string{"tag": "0.0.1"},
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:${tag}",
+					Cmds:      []Cmd{"ls"},
+					Env:       map[string]string{"IMAGE": "someimage", "TAG": "${version}"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{VarReferenceError{Step: "Test Step 1", Field: "cmds[1]", Var: "pipeline.owner"}},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"ls", "echo ${pipeline.owner}"},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{VarReferenceError{Step: "Test Step 1[b]", Field: "image", Var: "go"}},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Steps: []*Step{
+				&Step{
+					Name:   "Test Step 1",
+					Cmds:   []Cmd{"go test"},
+					Matrix: []MatrixInstance{{Name: "a", ImageName: "golang:1.6"}, {Name: "b", ImageName: "golang:${go}"}},
+				},
+			},
+		},
+	},
+	validationTestCase{
+		err: ValidationError{VarReferenceError{Step: "Test Step 2", Field: "when", Var: "deploy"}},
+		pipeline: Pipeline{
+			Name: "Test Pipeline",
+			Vars: map[string]string{"branch": "master"},
+			Steps: []*Step{
+				&Step{
+					Name:      "Test Step 1",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"ls"},
+				},
+				&Step{
+					Name:      "Test Step 2",
+					ImageName: "someimage:123",
+					Cmds:      []Cmd{"ls"},
+					After:     []string{"Test Step 1"},
+					When:      `vars.branch == "master" && vars.deploy == "true"`,
+				},
+			},
+		},
+	},
 }
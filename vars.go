@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// The built in vars every step can refer to as well as the pipeline's
+const (
+	// VarPipelineID is the ID of the pipeline
+	VarPipelineID = "pipeline.id"
+	// VarPipelineName is the name of the pipeline
+	VarPipelineName = "pipeline.name"
+	// VarStepName is the name of the step, including
+	// the instance name of a matrix step
+	VarStepName = "step.name"
+	// VarRunTime is the time the pipeline started running in UTC,
+	// formatted as 20060102T150405Z so it can be used in image tags
+	VarRunTime = "run.time"
+
+	runTimeFormat = "20060102T150405Z"
+)
+
+var (
+	builtinVars = []string{VarPipelineID, VarPipelineName, VarStepName, VarRunTime}
+
+	// varReference matches a reference to a var as ${name}, or an
+	// escaped reference as $${name} which is left as ${name}
+	varReference = regexp.MustCompile(`\$(\$?)\{([^}]*)\}`)
+	// leadingVarReference matches a reference at the start of a string
+	leadingVarReference = regexp.MustCompile(`^\$(\$?)\{([^}]*)\}`)
+	varName             = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// VarReferenceError is the validation error of
+// a reference to a var which isn't defined
+type VarReferenceError struct {
+	Step string
+	// Field is where in the step the reference is
+	Field string
+	Var   string
+}
+
+func (e VarReferenceError) Error() string {
+	if e.Field == "when" {
+		return fmt.Sprintf("Step %q refers to undefined var vars.%s in its when", e.Step, e.Var)
+	}
+	return fmt.Sprintf("Step %q refers to undefined var ${%s} in its %s", e.Step, e.Var, e.Field)
+}
+
+// interpolate replaces the references to vars in s with their values
+func interpolate(s string, vars map[string]string) string {
+	return varReference.ReplaceAllStringFunc(s, func(ref string) string {
+		match := varReference.FindStringSubmatch(ref)
+		if match[1] != "" {
+			return ref[1:]
+		}
+		if value, ok := vars[match[2]]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// interpolateShell replaces the references to vars in a shell script
+// with references to positional parameters, returning the script and
+// the values of the parameters. The shell doesn't parse the values
+// and each is a single word, whether the reference is quoted or not.
+func interpolateShell(script string, vars map[string]string) (string, []string) {
+	var out bytes.Buffer
+	var values []string
+	params := make(map[string]int)
+	// quote is the quote the script is inside, if any
+	var quote byte
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\\' && quote != '\'' && i+1 < len(script):
+			out.WriteString(script[i : i+2])
+			i++
+			continue
+		case c == '\'' || c == '"':
+			if quote == 0 {
+				quote = c
+			} else if quote == c {
+				quote = 0
+			}
+		case c == '$':
+			match := leadingVarReference.FindStringSubmatch(script[i:])
+			if match == nil {
+				break
+			}
+			i += len(match[0]) - 1
+			value, ok := vars[match[2]]
+			if match[1] != "" || !ok {
+				out.WriteString(interpolate(match[0], vars))
+				continue
+			}
+			n, ok := params[match[2]]
+			if !ok {
+				values = append(values, value)
+				n = len(values)
+				params[match[2]] = n
+			}
+			ref := fmt.Sprintf("${%d}", n)
+			switch quote {
+			case '"':
+				out.WriteString(ref)
+			case '\'':
+				// end the single quotes around it
+				out.WriteString(`'"` + ref + `"'`)
+			default:
+				out.WriteString(`"` + ref + `"`)
+			}
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return out.String(), values
+}
+
+// varReferences returns the names of the vars s refers to
+func varReferences(s string) []string {
+	var names []string
+	for _, match := range varReference.FindAllStringSubmatch(s, -1) {
+		if match[1] == "" {
+			names = append(names, match[2])
+		}
+	}
+	return names
+}
+
+// stepVars returns the values of the vars the step can refer to
+func stepVars(pipeline Pipeline, step *Step) map[string]string {
+	vars := make(map[string]string)
+	for name, value := range pipeline.Vars {
+		vars[name] = value
+	}
+	vars[VarPipelineID] = strconv.Itoa(int(pipeline.ID))
+	vars[VarPipelineName] = pipeline.Name
+	vars[VarStepName] = step.Name
+	vars[VarRunTime] = pipeline.StartTime.UTC().Format(runTimeFormat)
+	return vars
+}
+
+// interpolateEnv returns the environment with the references
+// to vars in its values replaced
+func interpolateEnv(env map[string]string, vars map[string]string) map[string]string {
+	if env == nil {
+		return nil
+	}
+	interpolated := make(map[string]string, len(env))
+	for k, v := range env {
+		interpolated[k] = interpolate(v, vars)
+	}
+	return interpolated
+}
+
+// checkVarReferences returns an error for the first reference in s
+// to a var which isn't defined. The pipeline's vars are given as
+// defined, the built in vars always are.
+func checkVarReferences(s string, defined map[string]string, step, field string) error {
+	for _, name := range varReferences(s) {
+		if _, ok := defined[name]; ok {
+			continue
+		}
+		if !containsString(builtinVars, name) {
+			return VarReferenceError{Step: step, Field: field, Var: name}
+		}
+	}
+	return nil
+}
+
+// validateVars checks that the names of the pipeline's vars are valid
+// and that the steps and their conditions only refer to vars which are
+// defined. Conditions can't refer to the built in vars.
+func validateVars(pipeline Pipeline) error {
+	for name := range pipeline.Vars {
+		if !varName.MatchString(name) {
+			return ErrInvalidVarName
+		}
+	}
+	for _, step := range pipeline.Steps {
+		if err := checkStepVarReferences(pipeline.Vars, step.Name, step.ImageName, step.Cmds, step.Env); err != nil {
+			return err
+		}
+		if !isOnSuccess(step.When) {
+			// a condition which doesn't parse is reported before this
+			_, refs, _ := parseCondition(step.When)
+			for _, name := range refs.vars {
+				if _, ok := pipeline.Vars[name]; !ok {
+					return VarReferenceError{Step: step.Name, Field: "when", Var: name}
+				}
+			}
+		}
+		for i, instance := range step.Matrix {
+			err := checkStepVarReferences(pipeline.Vars, matrixInstanceName(*step, i), instance.ImageName, nil, instance.Env)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkStepVarReferences(vars map[string]string, step, image string, cmds []Cmd, env map[string]string) error {
+	if err := checkVarReferences(image, vars, step, "image"); err != nil {
+		return err
+	}
+	for i, cmd := range cmds {
+		if err := checkVarReferences(string(cmd), vars, step, fmt.Sprintf("cmds[%d]", i)); err != nil {
+			return err
+		}
+	}
+	for _, k := range sortedKeys(env) {
+		if err := checkVarReferences(env[k], vars, step, fmt.Sprintf("env %s", k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
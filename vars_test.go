@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallVars(t *testing.T) {
+	pipeline := Pipeline{
+		ID:        7,
+		Name:      "Nightly",
+		StartTime: time.Date(2016, 6, 1, 13, 4, 5, 0, time.FixedZone("CEST", 2*60*60)),
+		Vars:      map[string]string{"tag": "0.0.1", "step": "not built in"},
+	}
+	step := &Step{Name: "build[linux]"}
+	vars := stepVars(pipeline, step)
+
+	cases := map[string]string{
+		"pipeline-build:${tag}":                      "pipeline-build:0.0.1",
+		"${pipeline.name}-${pipeline.id}":            "Nightly-7",
+		"${step.name} ${step}":                       "build[linux] not built in",
+		"app:${run.time}":                            "app:20160601T110405Z",
+		"$${tag} $$ ${ tag } ${undefined} ${unended": "${tag} $$ ${ tag } ${undefined} ${unended",
+	}
+	for s, expected := range cases {
+		assert.Equal(t, expected, interpolate(s, vars), "%s should be interpolated", s)
+	}
+	assert.Equal(t, map[string]string{"TAG": "0.0.1", "HOME": "${HOME}"},
+		interpolateEnv(map[string]string{"TAG": "${tag}", "HOME": "$${HOME}"}, vars), "Env values should be interpolated")
+	assert.Equal(t, []string{"tag", " tag ", "undefined"}, varReferences("$${x} ${tag} ${ tag } ${undefined}"), "References should be found")
+}
@@ -3,19 +3,22 @@ package main
 import (
 	"net/http"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/bbokorney/dockworker"
 	"github.com/emicklei/go-restful"
 )
 
 // WebhookAPI is the webhook receiver API
 type WebhookAPI struct {
-	webhookChan chan dockworker.Job
+	webhookListener WebhookListener
+	auth            webhookAuth
 }
 
 // NewWebhookAPI returns a new WebhookAPI
-func NewWebhookAPI(webhookChan chan dockworker.Job) WebhookAPI {
+func NewWebhookAPI(webhookListener WebhookListener, auth webhookAuth) WebhookAPI {
 	return WebhookAPI{
-		webhookChan: webhookChan,
+		webhookListener: webhookListener,
+		auth:            auth,
 	}
 }
 
@@ -24,26 +27,40 @@ func (api WebhookAPI) Register(container *restful.Container) {
 	ws := new(restful.WebService)
 
 	ws.Path("/webhook").
-		Consumes(restful.MIME_JSON)
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
 
 	ws.Route(ws.POST("").To(api.handleWebhook).
 		Operation("handleWebhook").
+		Param(ws.QueryParameter("pipeline", "id of the pipeline the job is for").DataType("int")).
+		Param(ws.QueryParameter("step", "name of the step the job is for")).
+		Param(ws.QueryParameter("token", "token signing the pipeline and step")).
 		Reads(dockworker.Job{}))
 
 	container.Add(ws)
 }
 
 func (api WebhookAPI) handleWebhook(request *restful.Request, response *restful.Response) {
+	owner, err := api.auth.verify(request.Request.URL.Query())
+	if err != nil {
+		log.Warnf("Rejected webhook from %s: %s", request.Request.RemoteAddr, err)
+		response.WriteHeaderAndEntity(http.StatusUnauthorized, errorResponse(err.Error()))
+		return
+	}
 	job := &dockworker.Job{}
-	err := request.ReadEntity(job)
+	err = request.ReadEntity(job)
 	if err != nil {
 		response.WriteHeaderAndEntity(http.StatusInternalServerError, errorResponse(err.Error()))
 		return
 	}
 
-	go func() {
-		api.webhookChan <- *job
-	}()
+	// the token only covers the pipeline and step, so check that
+	// the job is one of theirs rather than another step's
+	if err := api.webhookListener.Receive(*job, owner); err != nil {
+		log.Warnf("Rejected webhook for job %d from %s: %s", job.ID, request.Request.RemoteAddr, err)
+		response.WriteHeaderAndEntity(http.StatusForbidden, errorResponse(err.Error()))
+		return
+	}
 
 	response.WriteHeader(http.StatusAccepted)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+var (
+	// ErrMissingWebhookToken indicates a webhook didn't have a token
+	ErrMissingWebhookToken = errors.New("Webhook must have a pipeline, step, nonce and token")
+	// ErrInvalidWebhookToken indicates a webhook's token doesn't match
+	ErrInvalidWebhookToken = errors.New("Webhook token is invalid")
+	// ErrWebhookJobMismatch indicates a webhook's job wasn't
+	// created for the pipeline and step its token is for
+	ErrWebhookJobMismatch = errors.New("Webhook job does not belong to its pipeline and step")
+)
+
+// webhookAuth signs the webhook URLs given to dockworker for each
+// job, so that only webhooks sent to those URLs are accepted. The
+// token in each URL is the HMAC of the pipeline ID, step name and
+// a nonce made for the job.
+type webhookAuth struct {
+	secret []byte
+}
+
+func newWebhookAuth(secret string) webhookAuth {
+	return webhookAuth{
+		secret: []byte(secret),
+	}
+}
+
+// randomWebhookSecret is used if no secret is configured, in which
+// case the webhooks of jobs started before a restart are rejected
+func randomWebhookSecret() (string, error) {
+	return randomHex(32)
+}
+
+// newWebhookNonce returns a nonce for the webhook URL of a new job
+func newWebhookNonce() (string, error) {
+	return randomHex(16)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (a webhookAuth) token(owner jobOwner) string {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%d\x00%s\x00%s", owner.pipelineID, owner.step, owner.nonce)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signURL adds the pipeline, step, nonce and token to the webhook URL
+func (a webhookAuth) signURL(webhookURL string, owner jobOwner) string {
+	query := url.Values{}
+	query.Set("pipeline", strconv.Itoa(int(owner.pipelineID)))
+	query.Set("step", owner.step)
+	query.Set("nonce", owner.nonce)
+	query.Set("token", a.token(owner))
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		// the URL is from our config, so append to it as best we can
+		return webhookURL + "?" + query.Encode()
+	}
+	values := u.Query()
+	for k := range query {
+		values.Set(k, query.Get(k))
+	}
+	u.RawQuery = values.Encode()
+	return u.String()
+}
+
+// verify checks the token in the query of a received webhook,
+// returning the job the webhook is for
+func (a webhookAuth) verify(query url.Values) (jobOwner, error) {
+	pipeline, step, nonce, token := query.Get("pipeline"), query.Get("step"), query.Get("nonce"), query.Get("token")
+	if pipeline == "" || step == "" || nonce == "" || token == "" {
+		return jobOwner{}, ErrMissingWebhookToken
+	}
+	pipelineID, err := strconv.Atoi(pipeline)
+	if err != nil {
+		return jobOwner{}, ErrInvalidWebhookToken
+	}
+	owner := jobOwner{pipelineID: PipelineID(pipelineID), step: step, nonce: nonce}
+	if !hmac.Equal([]byte(token), []byte(a.token(owner))) {
+		return jobOwner{}, ErrInvalidWebhookToken
+	}
+	return owner, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bbokorney/dockworker"
+	"github.com/emicklei/go-restful"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallWebhookAuth(t *testing.T) {
+	auth := newWebhookAuth("secret")
+	signed := auth.signURL("http://pipeline:4322/webhook?source=dockworker", jobOwner{pipelineID: 12, step: "build step", nonce: "a1"})
+	u, err := url.Parse(signed)
+	if !assert.Nil(t, err, "Signed URL should parse") {
+		return
+	}
+	assert.Equal(t, "/webhook", u.Path, "Path should be unchanged")
+	assert.Equal(t, "dockworker", u.Query().Get("source"), "Existing query should be kept")
+	owner, err := auth.verify(u.Query())
+	assert.Nil(t, err, "Signed URL should verify")
+	assert.Equal(t, jobOwner{pipelineID: 12, step: "build step", nonce: "a1"}, owner, "Owner should be returned")
+
+	for field, value := range map[string]string{"pipeline": "13", "step": "deploy", "nonce": "b2"} {
+		tampered := u.Query()
+		tampered.Set(field, value)
+		_, err = auth.verify(tampered)
+		assert.Equal(t, ErrInvalidWebhookToken, err, "Token for another %s should fail", field)
+	}
+	_, err = newWebhookAuth("other").verify(u.Query())
+	assert.Equal(t, ErrInvalidWebhookToken, err, "Token with another secret should fail")
+	_, err = auth.verify(url.Values{})
+	assert.Equal(t, ErrMissingWebhookToken, err, "Missing token should fail")
+
+	webhookListener := NewWebhookListener(make(chan dockworker.Job), "http://pipeline/webhook", auth)
+	webhookChan := make(chan dockworker.Job, 1)
+	webhookListener.Register(5, owner, webhookChan)
+	container := restful.NewContainer()
+	NewWebhookAPI(webhookListener, auth).Register(container)
+	server := httptest.NewServer(container)
+	defer server.Close()
+
+	body := `{"id": 5, "status": "successful"}`
+	resp, err := http.Post(server.URL+"/webhook", restful.MIME_JSON, strings.NewReader(body))
+	if assert.Nil(t, err, "Request should succeed") {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "Unsigned webhook should be rejected")
+		resp.Body.Close()
+	}
+	resp, err = http.Post(server.URL+"/webhook?"+u.RawQuery, restful.MIME_JSON, strings.NewReader(body))
+	if assert.Nil(t, err, "Request should succeed") {
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, "Signed webhook should be accepted")
+		resp.Body.Close()
+	}
+	assert.Equal(t, dockworker.JobID(5), (<-webhookChan).ID, "Signed webhook should be passed on")
+
+	// a valid token for another step, or for an earlier
+	// job of the step, can't be used to update the job
+	for _, other := range []jobOwner{
+		{pipelineID: 12, step: "deploy", nonce: "a1"},
+		{pipelineID: 12, step: "build step", nonce: "c3"},
+	} {
+		otherURL, err := url.Parse(auth.signURL("http://pipeline:4322/webhook", other))
+		if !assert.Nil(t, err, "Signed URL should parse") {
+			return
+		}
+		resp, err = http.Post(server.URL+"/webhook?"+otherURL.RawQuery, restful.MIME_JSON, strings.NewReader(body))
+		if assert.Nil(t, err, "Request should succeed") {
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Webhook for job of %+v should be rejected", other)
+			resp.Body.Close()
+		}
+	}
+	assert.Equal(t, 0, len(webhookChan), "Rejected webhook should not be passed on")
+}
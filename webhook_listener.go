@@ -2,35 +2,86 @@ package main
 
 import (
 	"sync"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/bbokorney/dockworker"
 )
 
-// WebhookListener handles sending webhook notifications
-// to the appropriate listeners
+const (
+	// unknownJobTTL is how long an update for a job which hasn't been
+	// registered is kept, since the webhook for a job can arrive
+	// before the worker which created it has registered it
+	unknownJobTTL = 30 * time.Second
+	// unknownJobSweepInterval is how often expired updates are dropped
+	unknownJobSweepInterval = 5 * time.Second
+)
+
+// WebhookListener routes the job updates received
+// through webhooks to the worker which owns the job
 type WebhookListener interface {
 	Start()
 	Stop()
-	Register(chan dockworker.Job)
-	Unregister(chan dockworker.Job)
-	WebhookURL() string
+	// Register routes the updates for a job of the owner's step to the
+	// listener, including any received before it was registered
+	Register(jobID dockworker.JobID, owner jobOwner, listener chan dockworker.Job)
+	Unregister(jobID dockworker.JobID)
+	// Receive routes an update received through a webhook signed for
+	// the owner, returning ErrWebhookJobMismatch if the job is
+	// registered for another pipeline or step
+	Receive(job dockworker.Job, owner jobOwner) error
+	// WebhookURL returns the signed URL for the webhooks of a job
+	WebhookURL(owner jobOwner) string
 }
 
 // NewWebhookListener returns a new WebhookListener
-func NewWebhookListener(webhookChan chan dockworker.Job, webhookURL string) WebhookListener {
+func NewWebhookListener(webhookChan chan dockworker.Job, webhookURL string, auth webhookAuth) WebhookListener {
 	return &webhookListener{
 		webhookChan: webhookChan,
-		listeners:   make(map[chan dockworker.Job]bool),
-		lock:        &sync.RWMutex{},
+		routes:      make(map[dockworker.JobID]jobRoute),
+		pending:     make(map[dockworker.JobID][]pendingJobUpdate),
+		lock:        &sync.Mutex{},
 		webhookURL:  webhookURL,
+		auth:        auth,
+		stopChan:    make(chan struct{}),
+		stopOnce:    &sync.Once{},
 	}
 }
 
 type webhookListener struct {
 	webhookChan chan dockworker.Job
-	listeners   map[chan dockworker.Job]bool
-	lock        *sync.RWMutex
+	routes      map[dockworker.JobID]jobRoute
+	pending     map[dockworker.JobID][]pendingJobUpdate
+	lock        *sync.Mutex
 	webhookURL  string
+	auth        webhookAuth
+	stopChan    chan struct{}
+	stopOnce    *sync.Once
+}
+
+// jobOwner is the pipeline and step a job was created for
+type jobOwner struct {
+	pipelineID PipelineID
+	step       string
+	// nonce is different for each job, see Step.WebhookNonce
+	nonce string
+}
+
+// jobRoute is where the updates for a registered job go
+type jobRoute struct {
+	owner    jobOwner
+	listener chan dockworker.Job
+	// unregistered is closed when the job is unregistered
+	unregistered chan struct{}
+}
+
+// pendingJobUpdate is an update for a job which hasn't been registered yet
+type pendingJobUpdate struct {
+	job      dockworker.Job
+	received time.Time
+	// owner is who the webhook was signed for, it's nil for
+	// updates sent directly by executors which are trusted
+	owner *jobOwner
 }
 
 func (wl *webhookListener) Start() {
@@ -38,35 +89,124 @@ func (wl *webhookListener) Start() {
 }
 
 func (wl *webhookListener) Stop() {
-	// TODO: implement
+	wl.stopOnce.Do(func() {
+		close(wl.stopChan)
+	})
 }
 
-func (wl *webhookListener) Register(listener chan dockworker.Job) {
+func (wl *webhookListener) Register(jobID dockworker.JobID, owner jobOwner, listener chan dockworker.Job) {
 	wl.lock.Lock()
 	defer wl.lock.Unlock()
-	wl.listeners[listener] = true
+	wl.unregister(jobID)
+	route := jobRoute{
+		owner:        owner,
+		listener:     listener,
+		unregistered: make(chan struct{}),
+	}
+	wl.routes[jobID] = route
+	for _, update := range wl.pending[jobID] {
+		if update.owner != nil && *update.owner != owner {
+			log.Warnf("Dropping update for job %d received for pipeline %d step %q which it isn't for",
+				jobID, update.owner.pipelineID, update.owner.step)
+			continue
+		}
+		log.Debugf("Delivering update for job %d received before it was registered", jobID)
+		wl.deliver(route, update.job)
+	}
+	delete(wl.pending, jobID)
 }
 
-func (wl *webhookListener) Unregister(listener chan dockworker.Job) {
+func (wl *webhookListener) Unregister(jobID dockworker.JobID) {
 	wl.lock.Lock()
 	defer wl.lock.Unlock()
-	delete(wl.listeners, listener)
+	wl.unregister(jobID)
+}
+
+// unregister must be called with the lock held
+func (wl *webhookListener) unregister(jobID dockworker.JobID) {
+	if route, ok := wl.routes[jobID]; ok {
+		close(route.unregistered)
+		delete(wl.routes, jobID)
+	}
 }
 
-func (wl *webhookListener) WebhookURL() string {
-	return wl.webhookURL
+func (wl *webhookListener) WebhookURL(owner jobOwner) string {
+	return wl.auth.signURL(wl.webhookURL, owner)
 }
 
 func (wl *webhookListener) backgroundWorker() {
-	for job := range wl.webhookChan {
-		wl.lock.RLock()
-		for listener := range wl.listeners {
-			go sendMessage(listener, job)
+	sweep := time.NewTicker(unknownJobSweepInterval)
+	defer sweep.Stop()
+	for {
+		select {
+		case job := <-wl.webhookChan:
+			wl.lock.Lock()
+			wl.route(job, nil)
+			wl.lock.Unlock()
+		case now := <-sweep.C:
+			wl.dropExpired(now)
+		case <-wl.stopChan:
+			return
 		}
-		wl.lock.RUnlock()
 	}
 }
 
-func sendMessage(dest chan dockworker.Job, job dockworker.Job) {
-	dest <- job
+func (wl *webhookListener) Receive(job dockworker.Job, owner jobOwner) error {
+	wl.lock.Lock()
+	defer wl.lock.Unlock()
+	if route, ok := wl.routes[job.ID]; ok && route.owner != owner {
+		return ErrWebhookJobMismatch
+	}
+	wl.route(job, &owner)
+	return nil
+}
+
+// route must be called with the lock held
+func (wl *webhookListener) route(job dockworker.Job, owner *jobOwner) {
+	if route, ok := wl.routes[job.ID]; ok {
+		wl.deliver(route, job)
+		return
+	}
+	wl.pending[job.ID] = append(wl.pending[job.ID], pendingJobUpdate{
+		job:      job,
+		received: time.Now(),
+		owner:    owner,
+	})
+}
+
+func (wl *webhookListener) dropExpired(now time.Time) {
+	wl.lock.Lock()
+	defer wl.lock.Unlock()
+	for jobID, updates := range wl.pending {
+		if now.Sub(updates[len(updates)-1].received) > unknownJobTTL {
+			log.Debugf("Dropping %d updates for unknown job %d", len(updates), jobID)
+			delete(wl.pending, jobID)
+		}
+	}
+}
+
+// deliver never blocks so that one busy worker can't hold up the
+// updates for the others. Listeners have room for several updates for
+// each of their jobs. If there's no room an update which isn't the
+// job's last is dropped, the next one makes up for it. The last
+// update waits until there is room, since without polling the job
+// would otherwise never finish, or until the job is unregistered.
+func (wl *webhookListener) deliver(route jobRoute, job dockworker.Job) {
+	select {
+	case route.listener <- job:
+		return
+	default:
+	}
+	if !jobDone(job) {
+		log.Warnf("Dropping update for job %d with status %s, its worker is not keeping up", job.ID, job.Status)
+		return
+	}
+	log.Warnf("Holding final update for job %d with status %s until its worker catches up", job.ID, job.Status)
+	go func() {
+		select {
+		case route.listener <- job:
+		case <-route.unregistered:
+		case <-wl.stopChan:
+		}
+	}()
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bbokorney/dockworker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmallWebhookListener(t *testing.T) {
+	webhookChan := make(chan dockworker.Job)
+	wl := NewWebhookListener(webhookChan, "http://pipeline/webhook", newWebhookAuth("secret")).(*webhookListener)
+	wl.Start()
+	defer wl.Stop()
+
+	first := make(chan dockworker.Job, 4)
+	second := make(chan dockworker.Job, 4)
+	owner := jobOwner{pipelineID: 1, step: "build"}
+	wl.Register(1, owner, first)
+	wl.Register(2, owner, second)
+	webhookChan <- dockworker.Job{ID: 2, Status: dockworker.JobStatusSuccessful}
+	webhookChan <- dockworker.Job{ID: 1, Status: dockworker.JobStatusFailed}
+	assert.Equal(t, dockworker.JobID(1), (<-first).ID, "Update should go to the job's listener")
+	assert.Equal(t, dockworker.JobID(2), (<-second).ID, "Update should go to the job's listener")
+
+	// the webhook for a job can arrive before it is registered
+	webhookChan <- dockworker.Job{ID: 3, Status: dockworker.JobStatusSuccessful}
+	webhookChan <- dockworker.Job{ID: 4, Status: dockworker.JobStatusSuccessful}
+	// make sure both updates have been routed
+	wl.Unregister(1)
+	webhookChan <- dockworker.Job{ID: 1}
+	wl.Register(3, owner, first)
+	assert.Equal(t, dockworker.JobID(3), (<-first).ID, "Buffered update should be delivered on registration")
+	assert.Equal(t, 0, len(first), "Unregistered job's update should not be delivered")
+
+	wl.dropExpired(time.Now().Add(unknownJobTTL + time.Second))
+	wl.Register(4, owner, second)
+	assert.Equal(t, 0, len(second), "Expired updates should be dropped")
+
+	// a job's final update waits for its worker to catch up
+	full := make(chan dockworker.Job, 1)
+	wl.Register(5, owner, full)
+	webhookChan <- dockworker.Job{ID: 5, Status: dockworker.JobStatusRunning}
+	webhookChan <- dockworker.Job{ID: 5, Status: dockworker.JobStatusRunning}
+	webhookChan <- dockworker.Job{ID: 5, Status: dockworker.JobStatusSuccessful}
+	assert.Equal(t, dockworker.JobStatusRunning, (<-full).Status, "First update should be delivered")
+	select {
+	case job := <-full:
+		assert.Equal(t, dockworker.JobStatusSuccessful, job.Status, "Final update should not be dropped")
+	case <-time.After(time.Second):
+		t.Error("Final update should be delivered")
+	}
+	assert.Equal(t, 0, len(full), "Update which isn't final should be dropped")
+
+	// webhooks are only routed to the step they were signed for
+	other := jobOwner{pipelineID: 1, step: "test"}
+	assert.Equal(t, ErrWebhookJobMismatch, wl.Receive(dockworker.Job{ID: 5}, other), "Webhook for another step should be rejected")
+	assert.Nil(t, wl.Receive(dockworker.Job{ID: 6, Status: dockworker.JobStatusFailed}, other), "Webhook for unknown job should be kept")
+	assert.Nil(t, wl.Receive(dockworker.Job{ID: 6, Status: dockworker.JobStatusSuccessful}, owner), "Webhook for unknown job should be kept")
+	wl.Register(6, owner, second)
+	if assert.Equal(t, 1, len(second), "Only the owner's update should be delivered") {
+		assert.Equal(t, dockworker.JobStatusSuccessful, (<-second).Status, "Owner's update should be delivered")
+	}
+}
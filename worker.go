@@ -1,157 +1,714 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/bbokorney/dockworker"
-	"github.com/bbokorney/dockworker/client"
 )
 
 // Worker runs a Pipeline
 type Worker interface {
 	Run()
+	Resume()
+	Stop()
+	// Cancel returns ErrWorkerDone if the worker
+	// has already finished running the pipeline
+	Cancel(cancellation Cancellation) error
 }
 
-// NewWorker returns a new worker
-func NewWorker(pipeline Pipeline, dwClient client.Client, webhookListener WebhookListener, updater Updater) Worker {
-	webhookChan := make(chan dockworker.Job)
-	webhookListener.Register(webhookChan)
+// ErrWorkerDone indicates the worker has finished running its pipeline
+var ErrWorkerDone = errors.New("Worker has finished")
+
+// jobUpdatesBuffered is the number of updates buffered for each step
+const jobUpdatesBuffered = 4
+
+// jobLookupRetry is how often a job is looked up again when resuming
+// a pipeline fails to find out its state, before its step is given
+// an error status. Webhooks and polling can still settle the job in
+// the meantime.
+var jobLookupRetry = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     Duration(time.Second),
+	MaxBackoff:  Duration(30 * time.Second),
+}
+
+// NewWorker returns a new worker which runs at most maxSteps of
+// the pipeline's jobs at once, taking a slot from jobLimiter for each
+func NewWorker(pipeline Pipeline, executors ExecutorRegistry, webhookListener WebhookListener,
+	updater Updater, pollInterval time.Duration, jobLimiter JobLimiter, maxSteps int) Worker {
+	webhookChan := make(chan dockworker.Job, len(pipeline.Steps)*jobUpdatesBuffered)
 	steps := make(map[string]*Step)
 	for _, step := range pipeline.Steps {
 		steps[step.Name] = step
 	}
 	return &worker{
 		pipeline:        &pipeline,
-		dwClient:        dwClient,
+		executors:       executors,
 		webhookListener: webhookListener,
 		updater:         updater,
 		webhookChan:     webhookChan,
 		steps:           steps,
 		runningJobs:     make(map[dockworker.JobID]int),
+		stopLock:        &sync.Mutex{},
+		stopChan:        make(chan struct{}, 1),
+		retryChan:       make(chan int, len(pipeline.Steps)),
+		timeoutChan:     make(chan dockworker.JobID),
+		lookupChan:      make(chan dockworker.JobID, len(pipeline.Steps)),
+		doneChan:        make(chan struct{}),
+		stepTimers:      make(map[dockworker.JobID]*time.Timer),
+		timedOutJobs:    make(map[dockworker.JobID]bool),
+		lookupFailures:  make(map[dockworker.JobID]int),
+		pollInterval:    pollInterval,
+		jobLimiter:      jobLimiter,
+		maxSteps:        maxSteps,
+		slotChan:        make(chan struct{}, 1),
 	}
 }
 
 type worker struct {
 	pipeline        *Pipeline
-	dwClient        client.Client
+	executors       ExecutorRegistry
 	webhookListener WebhookListener
 	updater         Updater
 	webhookChan     chan dockworker.Job
 	steps           map[string]*Step
 	runningJobs     map[dockworker.JobID]int
+	stopChan        chan struct{}
+	retryChan       chan int
+	timeoutChan     chan dockworker.JobID
+	lookupChan      chan dockworker.JobID
+	doneChan        chan struct{}
+	pipelineTimer   *time.Timer
+	stepTimers      map[dockworker.JobID]*time.Timer
+	timedOutJobs    map[dockworker.JobID]bool
+	pollInterval    time.Duration
+	jobLimiter      JobLimiter
+	maxSteps        int
+	// slotChan is sent to when a job slot is reserved for the pipeline
+	slotChan chan struct{}
+	// waitingForSlot is set if a step couldn't start
+	// because all the service's job slots are taken
+	waitingForSlot bool
+	// pendingRetries are the steps ready to retry
+	// which are waiting for a free job slot
+	pendingRetries []int
+	// lookupFailures counts the failed lookups of the
+	// resumed jobs whose state isn't known yet
+	lookupFailures map[dockworker.JobID]int
+	// stopLock guards the stop requested of the worker,
+	// which stopChan signals, and whether it has finished
+	stopLock *sync.Mutex
+	// cancellation is the cancel requested of the
+	// worker which hasn't been handled yet
+	cancellation *Cancellation
+	// finished is set once the worker stops taking requests
+	finished bool
 }
 
 func (w *worker) Run() {
 	defer w.cleanup()
 	log.Infof("Starting run of pipeline %d", w.pipeline.ID)
+	w.pipeline.StartTime = time.Now()
 	w.updatePipelineStatus(StatusRunning)
+	w.startPipelineTimer()
 	// initialize ourselves with a step to run
-	if err := w.doRun(); err != nil {
+	w.finish(w.doRun())
+}
+
+// Resume continues a pipeline which was interrupted,
+// picking up any jobs which were started before
+func (w *worker) Resume() {
+	defer w.cleanup()
+	if w.pipeline.Status == StatusQueued {
+		log.Infof("Starting run of pipeline %d", w.pipeline.ID)
+		w.pipeline.StartTime = time.Now()
+		w.updatePipelineStatus(StatusRunning)
+		w.startPipelineTimer()
+		w.finish(w.doRun())
+		return
+	}
+	log.Infof("Resuming run of pipeline %d with status %s", w.pipeline.ID, w.pipeline.Status)
+	w.startPipelineTimer()
+	w.finish(w.doResume())
+}
+
+// Stop asks the worker to stop the pipeline's jobs
+// and finish with a stopped status
+func (w *worker) Stop() {
+	w.requestStop(nil)
+}
+
+// Cancel asks the worker to stop the pipeline's jobs
+// and finish with a cancelled status
+func (w *worker) Cancel(cancellation Cancellation) error {
+	return w.requestStop(&cancellation)
+}
+
+// requestStop records the stop for the worker to handle. A cancel is
+// never lost, even if it's requested while a stop is still pending.
+func (w *worker) requestStop(cancellation *Cancellation) error {
+	w.stopLock.Lock()
+	defer w.stopLock.Unlock()
+	if w.finished {
+		return ErrWorkerDone
+	}
+	if cancellation != nil && w.cancellation == nil {
+		w.cancellation = cancellation
+	}
+	select {
+	case w.stopChan <- struct{}{}:
+	default:
+		log.Debugf("Stop of pipeline %d already pending", w.pipeline.ID)
+	}
+	return nil
+}
+
+// takeStop returns the cancel requested of the worker since
+// the last stop was handled, or nil for a plain stop
+func (w *worker) takeStop() *Cancellation {
+	w.stopLock.Lock()
+	defer w.stopLock.Unlock()
+	cancellation := w.cancellation
+	w.cancellation = nil
+	return cancellation
+}
+
+func (w *worker) finish(err error) {
+	w.pipeline.EndTime = time.Now()
+	if err != nil {
 		w.updatePipelineStatus(StatusError)
 		log.Errorf("Failed to run pipeline %d: %s", w.pipeline.ID, err)
 		return
 	}
-	log.Infof("Successful run of pipeline %d", w.pipeline.ID)
+	log.Infof("Finished run of pipeline %d with status %s", w.pipeline.ID, w.pipeline.Status)
 }
 
 func (w *worker) doRun() error {
-	// start the steps with no dependencies
-	if err := w.runReadySteps(); err != nil {
+	// start the steps with no dependencies,
+	// a rerun may have nothing left to run
+	done, err := w.advance()
+	if err != nil || done {
+		return err
+	}
+	return w.waitForUpdates()
+}
+
+func (w *worker) doResume() error {
+	// rebuild the set of jobs we're waiting on
+	for i, step := range w.pipeline.Steps {
+		if stepAwaitingJob(*step) {
+			w.runningJobs[step.JobID] = i
+			w.jobLimiter.Hold(w.pipeline.ID)
+			w.webhookListener.Register(step.JobID, w.jobOwner(step), w.webhookChan)
+			if step.Status == StatusTimedOut {
+				w.timedOutJobs[step.JobID] = true
+			}
+		}
+	}
+
+	// any of these jobs may have finished while we weren't listening
+	var jobIDs []dockworker.JobID
+	for jobID := range w.runningJobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	for _, jobID := range jobIDs {
+		w.lookupFailures[jobID] = 0
+		done, err := w.lookupJob(jobID)
+		if err != nil || done {
+			return err
+		}
+	}
+
+	if w.pipeline.Status == StatusRunning {
+		// any pending retries were lost
+		for i, step := range w.pipeline.Steps {
+			if step.Status == StatusRetrying {
+				w.scheduleRetry(i)
+			}
+		}
+	} else {
+		w.abandonRetries()
+	}
+	// steps may have become ready right before we were interrupted
+	done, err := w.advance()
+	if err != nil || done {
 		return err
 	}
+	return w.waitForUpdates()
+}
+
+func (w *worker) waitForUpdates() error {
+	var pipelineTimeout <-chan time.Time
+	if w.pipelineTimer != nil {
+		pipelineTimeout = w.pipelineTimer.C
+	}
+	var poll <-chan time.Time
+	if w.pollInterval > 0 {
+		pollTicker := time.NewTicker(w.pollInterval)
+		defer pollTicker.Stop()
+		poll = pollTicker.C
+	}
 	for {
 		select {
 		case jobUpdate := <-w.webhookChan:
 			log.Debugf("Received job update %+v", jobUpdate)
 			// we've received a job update
-			done, err := w.handleUpdate(jobUpdate)
+			done, err := w.handleUpdate(jobUpdate, UpdateSourceWebhook)
 			if err != nil {
 				return err
 			}
 			if done {
 				return nil
 			}
+		case <-w.stopChan:
+			done, err := w.handleStop(w.takeStop())
+			if err != nil || done {
+				return err
+			}
+		case stepIndex := <-w.retryChan:
+			if err := w.retryStep(stepIndex); err != nil {
+				return err
+			}
+		case jobID := <-w.timeoutChan:
+			w.handleStepTimeout(jobID)
+		case jobID := <-w.lookupChan:
+			done, err := w.lookupJob(jobID)
+			if err != nil || done {
+				return err
+			}
+		case <-w.slotChan:
+			done, err := w.advance()
+			if err != nil || done {
+				return err
+			}
+		case <-pipelineTimeout:
+			pipelineTimeout = nil
+			done, err := w.handlePipelineTimeout()
+			if err != nil || done {
+				return err
+			}
+		case <-poll:
+			done, err := w.pollJobs()
+			if err != nil || done {
+				return err
+			}
+		}
+	}
+}
+
+// pollJobs asks dockworker for the state of the running jobs,
+// handling any which have finished as if their webhook was
+// received, in case it was lost
+func (w *worker) pollJobs() (done bool, err error) {
+	reconcileMetrics.Add(metricPolls, 1)
+	var jobIDs []dockworker.JobID
+	for jobID := range w.runningJobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	for _, jobID := range jobIDs {
+		reconcileMetrics.Add(metricJobsChecked, 1)
+		job, err := w.getJob(jobID)
+		if err != nil {
+			// try again on the next poll
+			reconcileMetrics.Add(metricPollErrors, 1)
+			log.Warnf("Failed to poll job %d for pipeline %d: %s", jobID, w.pipeline.ID, err)
+			continue
+		}
+		if !jobDone(job) {
+			w.jobFound(job)
+			continue
+		}
+		reconcileMetrics.Add(metricUpdatesRecovered, 1)
+		log.Warnf("Job %d for pipeline %d finished with status %s without a webhook",
+			jobID, w.pipeline.ID, job.Status)
+		done, err := w.handleUpdate(job, UpdateSourcePoll)
+		if err != nil || done {
+			return done, err
 		}
 	}
+	return false, nil
 }
 
-func (w *worker) handleUpdate(job dockworker.Job) (done bool, err error) {
-	// check if this one of our jobs
-	if _, contains := w.runningJobs[job.ID]; !contains {
-		// this isn't a job for this pipeline
+// lookupJob finds out the state of a resumed job, handling it
+// if it finished while we weren't listening. A failed lookup is
+// tried again later, up to the limit of jobLookupRetry.
+func (w *worker) lookupJob(jobID dockworker.JobID) (done bool, err error) {
+	failures, pending := w.lookupFailures[jobID]
+	if _, running := w.runningJobs[jobID]; !pending || !running {
+		// an update for the job was received in the meantime
+		return false, nil
+	}
+	job, err := w.getJob(jobID)
+	if err != nil {
+		failures++
+		w.lookupFailures[jobID] = failures
+		if failures < jobLookupRetry.MaxAttempts {
+			delay := jobLookupRetry.delay(failures)
+			log.Warnf("Failed to get job %d for pipeline %d, trying again in %s: %s",
+				jobID, w.pipeline.ID, delay, err)
+			time.AfterFunc(delay, func() {
+				select {
+				case w.lookupChan <- jobID:
+				case <-w.doneChan:
+				}
+			})
+			return false, nil
+		}
+		log.Errorf("Giving up on job %d for pipeline %d after %d failed lookups: %s",
+			jobID, w.pipeline.ID, failures, err)
+		delete(w.lookupFailures, jobID)
+		step := w.pipeline.Steps[w.runningJobs[jobID]]
+		return w.handleUpdate(dockworker.Job{
+			ID:        jobID,
+			Status:    dockworker.JobStatusError,
+			StartTime: step.StartTime,
+			EndTime:   time.Now(),
+		}, UpdateSourceResume)
+	}
+	if !jobDone(job) {
+		w.jobFound(job)
 		return false, nil
 	}
+	delete(w.lookupFailures, jobID)
+	return w.handleUpdate(job, UpdateSourceResume)
+}
+
+// jobFound starts timing a resumed job once it's known to be running
+func (w *worker) jobFound(job dockworker.Job) {
+	if _, pending := w.lookupFailures[job.ID]; pending {
+		delete(w.lookupFailures, job.ID)
+		w.startStepTimer(job)
+	}
+}
+
+// handleStop begins stopping the pipeline at the request
+// of the manager rather than because of a failed step
+func (w *worker) handleStop(cancellation *Cancellation) (done bool, err error) {
+	w.pipeline.StopRequested = true
+	if cancellation != nil && w.pipeline.Cancellation == nil {
+		log.Infof("Pipeline %d cancelled by %s", w.pipeline.ID, cancellation.By)
+		w.pipeline.Cancellation = cancellation
+	}
+	return w.stopPipeline()
+}
+
+// handlePipelineTimeout stops a pipeline which
+// has been running for longer than its timeout
+func (w *worker) handlePipelineTimeout() (done bool, err error) {
+	log.Infof("Pipeline %d timed out after %s", w.pipeline.ID, time.Duration(w.pipeline.Timeout))
+	w.pipeline.TimedOut = true
+	for jobID := range w.runningJobs {
+		w.timedOutJobs[jobID] = true
+	}
+	return w.stopPipeline()
+}
+
+// stopPipeline stops all the running jobs, and finishes
+// the pipeline if there is nothing left to wait for
+func (w *worker) stopPipeline() (done bool, err error) {
+	if w.pipeline.Status != StatusStopping {
+		log.Infof("Stopping pipeline %d", w.pipeline.ID)
+		w.pipeline.Status = StatusStopping
+		w.stopRunningJobs()
+		w.abandonRetries()
+	} else if w.draining() {
+		// also stop any cleanup steps started after a failure
+		w.stopRunningJobs()
+	}
+	return w.advance()
+}
+
+// draining checks if the pipeline is being stopped because
+// the service is shutting down, in which case no further
+// steps should be started
+func (w *worker) draining() bool {
+	return w.pipeline.StopRequested && w.pipeline.Cancellation == nil
+}
+
+// handleStepTimeout stops a job which has been running for longer
+// than its step's timeout. The step finishes when the update
+// for the stopped job is received.
+func (w *worker) handleStepTimeout(jobID dockworker.JobID) {
+	stepIndex, running := w.runningJobs[jobID]
+	if !running || w.timedOutJobs[jobID] {
+		return
+	}
+	step := w.pipeline.Steps[stepIndex]
+	log.Infof("Step %s of pipeline %d timed out after %s", step.Name, w.pipeline.ID, time.Duration(step.Timeout))
+	w.timedOutJobs[jobID] = true
+	w.stopJob(jobID)
+	step.Status = StatusTimedOut
+	w.saveUpdatedPipeline()
+}
+
+func (w *worker) startPipelineTimer() {
+	if w.pipeline.Timeout <= 0 {
+		return
+	}
+	remaining := time.Duration(w.pipeline.Timeout) - time.Since(w.pipeline.StartTime)
+	w.pipelineTimer = time.NewTimer(remaining)
+}
+
+// startStepTimer starts timing a job if its step has a timeout
+func (w *worker) startStepTimer(job dockworker.Job) {
+	step := w.pipeline.Steps[w.runningJobs[job.ID]]
+	if step.Timeout <= 0 {
+		return
+	}
+	remaining := time.Duration(step.Timeout)
+	if !job.StartTime.IsZero() && job.StartTime.After(NotRunTime) {
+		remaining -= time.Since(job.StartTime)
+	}
+	w.stepTimers[job.ID] = time.AfterFunc(remaining, func() {
+		select {
+		case w.timeoutChan <- job.ID:
+		case <-w.doneChan:
+		}
+	})
+}
+
+func (w *worker) stopStepTimer(jobID dockworker.JobID) {
+	if timer, ok := w.stepTimers[jobID]; ok {
+		timer.Stop()
+		delete(w.stepTimers, jobID)
+	}
+}
+
+// stoppedStatus is the final status of a pipeline
+// once all of its jobs have stopped
+func (w *worker) stoppedStatus() Status {
+	if w.pipeline.Cancellation != nil {
+		return StatusCancelled
+	}
+	if w.pipeline.TimedOut {
+		return StatusTimedOut
+	}
+	if w.pipeline.StopRequested {
+		return StatusStopped
+	}
+	return StatusFailed
+}
 
+func (w *worker) handleUpdate(job dockworker.Job, source string) (done bool, err error) {
+	if !w.journalUpdate(job, source) {
+		return false, nil
+	}
 	stepIndex := w.runningJobs[job.ID]
+	step := w.pipeline.Steps[stepIndex]
+	if !jobDone(job) {
+		log.Debugf("Job %d has status %s", job.ID, job.Status)
+		if job.Status == dockworker.JobStatusRunning && job.StartTime.After(NotRunTime) {
+			step.StartTime = job.StartTime
+		}
+		w.saveUpdatedPipeline()
+		return false, nil
+	}
+
 	delete(w.runningJobs, job.ID)
-	w.pipeline.Steps[stepIndex].StartTime = job.StartTime
-	w.pipeline.Steps[stepIndex].EndTime = job.EndTime
-	w.pipeline.Steps[stepIndex].JobURL = fmt.Sprintf("%s/jobs/%d", w.dwClient.BaseURL(), job.ID)
+	delete(w.lookupFailures, job.ID)
+	w.jobLimiter.Release(w.pipeline.ID)
+	w.webhookListener.Unregister(job.ID)
+	w.stopStepTimer(job.ID)
+	step.StartTime = job.StartTime
+	step.EndTime = job.EndTime
 
 	log.Debugf("Job %d has status %s", job.ID, job.Status)
 	// set the status of the step
 	switch job.Status {
 	case dockworker.JobStatusFailed:
-		w.pipeline.Steps[stepIndex].Status = StatusFailed
+		step.Status = StatusFailed
 	case dockworker.JobStatusError:
-		w.pipeline.Steps[stepIndex].Status = StatusError
+		step.Status = StatusError
 	case dockworker.JobStatusStopped:
-		w.pipeline.Steps[stepIndex].Status = StatusStopped
+		step.Status = StatusStopped
 	case dockworker.JobStatusSuccessful:
-		w.pipeline.Steps[stepIndex].Status = StatusSuccessful
+		step.Status = StatusSuccessful
+	}
+	if w.timedOutJobs[job.ID] {
+		// we stopped the job because it took too long
+		delete(w.timedOutJobs, job.ID)
+		step.Status = StatusTimedOut
 	}
+	step.Attempts = append(step.Attempts, Attempt{
+		JobID:     job.ID,
+		JobURL:    step.JobURL,
+		Status:    step.Status,
+		StartTime: step.StartTime,
+		EndTime:   step.EndTime,
+	})
 
-	if w.pipeline.Status != StatusStopping && w.pipeline.Steps[stepIndex].Status != StatusSuccessful {
-		// this is the first detection of failure
-		// We need to start cleaning up
-		w.pipeline.Status = StatusStopping
-		log.Debugf("Pipeline %d has status %s", w.pipeline.ID, StatusStopping)
-		w.stopRunningJobs()
-		w.setQueuedToNotRun()
+	if w.shouldRetry(*step) {
+		w.scheduleRetry(stepIndex)
+		// the job's slot may let another step start
+		return w.advance()
 	}
 
-	// check if we're stopping the pipeline
-	if w.pipeline.Status == StatusStopping {
-		done = false
-		if len(w.runningJobs) == 0 {
-			// no jobs left running, we can exit
-			w.pipeline.Status = StatusFailed
-			log.Debugf("Pipeline %d has status %s and 0 running jobs", w.pipeline.ID, StatusFailed)
-			done = true
+	if step.Status != StatusSuccessful {
+		if step.AllowFailure && w.pipeline.Status != StatusStopping {
+			log.Warnf("Step %s of pipeline %d has status %s but is allowed to fail",
+				step.Name, w.pipeline.ID, step.Status)
+		} else if w.pipeline.Status != StatusStopping {
+			// this is the first detection of failure
+			// We need to start cleaning up
+			w.pipeline.Status = StatusStopping
+			log.Debugf("Pipeline %d has status %s", w.pipeline.ID, StatusStopping)
+			w.stopRunningJobs()
+			w.abandonRetries()
 		}
-		w.saveUpdatedPipeline()
-		return done, nil
 	}
 
-	// now we know the job was successful and
-	// the pipeline is still running
-	w.saveUpdatedPipeline()
-
 	// this job finishing could have satisfied the
-	// dependencies of another waiting step
-	// start any such steps
+	// dependencies or condition of another waiting step
+	return w.advance()
+}
+
+// journalUpdate records a job update in the pipeline's journal,
+// returning true if it should be applied. Updates are only applied
+// the first time they are received and while the job is running,
+// so a final update can't be undone by a late or repeated one.
+func (w *worker) journalUpdate(job dockworker.Job, source string) bool {
+	var stepName string
+	for i := range w.pipeline.Journal {
+		entry := &w.pipeline.Journal[i]
+		if entry.JobID != job.ID {
+			continue
+		}
+		stepName = entry.Step
+		if entry.Status == job.Status {
+			entry.Deliveries++
+			log.Debugf("Ignoring repeated update for job %d with status %s", job.ID, job.Status)
+			return false
+		}
+	}
+	stepIndex, running := w.runningJobs[job.ID]
+	if running {
+		stepName = w.pipeline.Steps[stepIndex].Name
+	} else if stepName == "" {
+		// the job isn't one of ours
+		return false
+	} else {
+		log.Debugf("Ignoring update for job %d with status %s after it finished", job.ID, job.Status)
+	}
+	w.pipeline.Journal = append(w.pipeline.Journal, JobUpdate{
+		JobID:      job.ID,
+		Step:       stepName,
+		Status:     job.Status,
+		Source:     source,
+		Received:   time.Now(),
+		Deliveries: 1,
+		Applied:    running,
+	})
+	return running
+}
+
+// advance starts any steps which are now able to run, and
+// finishes the pipeline if there is nothing left to wait for
+func (w *worker) advance() (done bool, err error) {
+	w.waitingForSlot = false
+	if err := w.runPendingRetries(); err != nil {
+		return true, err
+	}
 	if err := w.runReadySteps(); err != nil {
 		return true, err
 	}
-
-	// check if all the steps are done
-	if w.allStepsDone() {
-		w.pipeline.Status = StatusSuccessful
+	if !w.waitingForSlot {
+		// give back any slot reserved for a step which no longer needs it
+		w.jobLimiter.Withdraw(w.pipeline.ID)
+	}
+	if !w.idle() {
 		w.saveUpdatedPipeline()
-		return true, nil
+		return false, nil
 	}
-	return false, nil
+	// any steps still queued can never run
+	w.setQueuedToNotRun()
+	if w.pipeline.Status == StatusStopping {
+		w.pipeline.Status = w.stoppedStatus()
+	} else {
+		w.pipeline.Status = w.successStatus()
+	}
+	log.Debugf("Pipeline %d has status %s and 0 running jobs", w.pipeline.ID, w.pipeline.Status)
+	w.saveUpdatedPipeline()
+	return true, nil
+}
+
+// idle checks if the pipeline has no running jobs
+// and no steps waiting to be retried or for a job slot
+func (w *worker) idle() bool {
+	if len(w.runningJobs) > 0 || w.waitingForSlot {
+		return false
+	}
+	for _, step := range w.pipeline.Steps {
+		if step.Status == StatusRetrying {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *worker) shouldRetry(step Step) bool {
+	if step.Retry == nil || w.pipeline.Status == StatusStopping {
+		return false
+	}
+	if len(step.Attempts) >= step.Retry.MaxAttempts {
+		return false
+	}
+	return step.Retry.retryable(step.Status)
+}
+
+// scheduleRetry runs the step again once its backoff has passed
+func (w *worker) scheduleRetry(stepIndex int) {
+	step := w.pipeline.Steps[stepIndex]
+	delay := step.Retry.delay(len(step.Attempts))
+	log.Infof("Retrying step %s of pipeline %d in %s after attempt %d of %d",
+		step.Name, w.pipeline.ID, delay, len(step.Attempts), step.Retry.MaxAttempts)
+	step.Status = StatusRetrying
+	w.saveUpdatedPipeline()
+	// the channel has room for every step so this never blocks
+	time.AfterFunc(delay, func() {
+		w.retryChan <- stepIndex
+	})
+}
+
+func (w *worker) retryStep(stepIndex int) error {
+	step := w.pipeline.Steps[stepIndex]
+	if step.Status != StatusRetrying {
+		// the pipeline started stopping while we waited
+		return nil
+	}
+	log.Debugf("Retrying step %+v", step)
+	started, err := w.startStep(step, stepIndex)
+	if err == nil && !started {
+		w.pendingRetries = append(w.pendingRetries, stepIndex)
+	}
+	return err
+}
+
+// runPendingRetries retries the steps which
+// were waiting for a job slot, in order
+func (w *worker) runPendingRetries() error {
+	pending := w.pendingRetries
+	w.pendingRetries = nil
+	for _, stepIndex := range pending {
+		if err := w.retryStep(stepIndex); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (w *worker) stopRunningJobs() {
 	for jobID, stepIndex := range w.runningJobs {
 		log.Debugf("Stopping job %d for step %d", jobID, stepIndex)
-		if err := w.dwClient.StopJob(dockworker.JobID(jobID)); err != nil {
-			log.Errorf("Error stopping job %d: %s", jobID, err)
+		w.stopJob(jobID)
+		if w.timedOutJobs[jobID] {
+			w.pipeline.Steps[stepIndex].Status = StatusTimedOut
+		} else {
+			w.pipeline.Steps[stepIndex].Status = StatusStopped
 		}
-		w.pipeline.Steps[stepIndex].Status = StatusStopped
 	}
 }
 
@@ -163,42 +720,151 @@ func (w *worker) setQueuedToNotRun() {
 	}
 }
 
+// abandonRetries cancels any pending retries,
+// leaving the result of the last attempt
+func (w *worker) abandonRetries() {
+	for _, step := range w.pipeline.Steps {
+		if step.Status == StatusRetrying {
+			step.Status = step.Attempts[len(step.Attempts)-1].Status
+		}
+	}
+}
+
 func (w *worker) runReadySteps() error {
 	log.Debug("Running ready steps")
-	for i, step := range w.pipeline.Steps {
-		if stepDoneOrRunning(*step) {
-			continue
-		}
-		if w.dependenciesDone(*step) {
-			log.Debugf("Running step %+v", step)
-			if err := w.runStep(step, i); err != nil {
-				return err
+	// skipping a step can make the steps after it
+	// unable to run so repeat until nothing changes
+	for changed := true; changed; {
+		changed = false
+		for i, step := range w.pipeline.Steps {
+			if step.Status != StatusQueued {
+				continue
+			}
+			switch w.checkDependencies(*step) {
+			case dependenciesSatisfied:
+				started, err := w.startStep(step, i)
+				if err != nil {
+					return err
+				}
+				if started {
+					log.Debugf("Done starting step %+v", step)
+				}
+			case dependenciesUnsatisfiable:
+				log.Debugf("Skipping step %s of pipeline %d", step.Name, w.pipeline.ID)
+				step.Status = StatusNotRun
+				changed = true
 			}
-			log.Debugf("Done starting step %+v", step)
 		}
 	}
 	return nil
 }
 
+// startStep runs the step if the pipeline and the service are
+// below their job limits, otherwise it is left to wait
+func (w *worker) startStep(step *Step, stepIndex int) (started bool, err error) {
+	if w.maxSteps > 0 && len(w.runningJobs) >= w.maxSteps {
+		log.Debugf("Step %s of pipeline %d waiting for one of its %d running jobs to finish",
+			step.Name, w.pipeline.ID, len(w.runningJobs))
+		return false, nil
+	}
+	if !w.jobLimiter.Acquire(*w.pipeline, w.slotChan) {
+		log.Debugf("Step %s of pipeline %d waiting for a job slot", step.Name, w.pipeline.ID)
+		w.waitingForSlot = true
+		return false, nil
+	}
+	log.Debugf("Running step %+v", step)
+	if err := w.runStep(step, stepIndex); err != nil {
+		w.jobLimiter.Release(w.pipeline.ID)
+		return false, err
+	}
+	return true, nil
+}
+
 func (w *worker) runStep(step *Step, stepIndex int) error {
+	vars := stepVars(*w.pipeline, step)
+	cmds, err := convertCmds(step.Cmds, step.Shell, vars)
+	if err != nil {
+		return err
+	}
+	// the webhooks of the step's earlier jobs are no longer accepted
+	nonce, err := newWebhookNonce()
+	if err != nil {
+		return err
+	}
+	step.WebhookNonce = nonce
 	job := dockworker.Job{
-		ImageName:  step.ImageName,
-		Cmds:       convertCmds(step.Cmds),
-		Env:        step.Env,
-		WebhookURL: w.webhookListener.WebhookURL(),
+		ImageName:  interpolate(step.ImageName, vars),
+		Cmds:       cmds,
+		Env:        interpolateEnv(step.Env, vars),
+		WebhookURL: w.webhookListener.WebhookURL(w.jobOwner(step)),
+	}
+	executor, err := w.executor(step)
+	if err != nil {
+		return err
 	}
-	createdJob, err := w.dwClient.CreateJob(job)
+	createdJob, err := executor.CreateJob(job)
 	if err != nil {
 		log.Errorf("Failed to create job %+v for pipeline %d: %s", job, w.pipeline.ID, err)
 		return err
 	}
 	log.Debugf("Job started %+v", createdJob)
 	w.runningJobs[createdJob.ID] = stepIndex
+	w.webhookListener.Register(createdJob.ID, w.jobOwner(step), w.webhookChan)
+	w.startStepTimer(createdJob)
+	step.JobID = createdJob.ID
+	step.JobURL = executor.JobURL(createdJob.ID)
 	step.Status = StatusRunning
+	// clear the times of any previous attempt
+	step.StartTime = NotRunTime
+	step.EndTime = NotRunTime
 	w.saveUpdatedPipeline()
 	return nil
 }
 
+// executor returns the executor for the step's runner
+func (w *worker) executor(step *Step) (Executor, error) {
+	runner := step.Runner
+	if runner == "" {
+		// steps saved before runners existed ran on dockworker
+		runner = RunnerDockworker
+	}
+	executor, ok := w.executors.Get(runner)
+	if !ok {
+		return nil, fmt.Errorf("No executor for runner %s of step %s", runner, step.Name)
+	}
+	return executor, nil
+}
+
+// getJob fetches the state of a running job from its executor
+func (w *worker) getJob(jobID dockworker.JobID) (dockworker.Job, error) {
+	step := w.pipeline.Steps[w.runningJobs[jobID]]
+	executor, err := w.executor(step)
+	if err != nil {
+		return dockworker.Job{}, err
+	}
+	job, err := executor.GetJob(jobID)
+	if err == ErrLocalJobNotFound {
+		// local jobs are lost when the service restarts
+		return dockworker.Job{
+			ID:        jobID,
+			Status:    dockworker.JobStatusError,
+			StartTime: step.StartTime,
+			EndTime:   time.Now(),
+		}, nil
+	}
+	return job, err
+}
+
+func (w *worker) stopJob(jobID dockworker.JobID) {
+	executor, err := w.executor(w.pipeline.Steps[w.runningJobs[jobID]])
+	if err == nil {
+		err = executor.StopJob(jobID)
+	}
+	if err != nil {
+		log.Errorf("Error stopping job %d: %s", jobID, err)
+	}
+}
+
 func (w *worker) updatePipelineStatus(status Status) {
 	w.pipeline.Status = status
 	w.saveUpdatedPipeline()
@@ -210,51 +876,194 @@ func (w *worker) saveUpdatedPipeline() {
 	}
 }
 
-func (w *worker) dependenciesDone(step Step) bool {
+type dependencyState int
+
+const (
+	dependenciesWaiting dependencyState = iota
+	dependenciesSatisfied
+	dependenciesUnsatisfiable
+)
+
+// checkDependencies decides if a queued step can run
+// based on its dependencies and its When condition
+func (w *worker) checkDependencies(step Step) dependencyState {
+	finished := true
+	failedDep := false
+	allowedFailure := false
 	for _, dep := range step.After {
-		if w.steps[dep].Status != StatusSuccessful {
-			return false
+		depStep := w.steps[dep]
+		switch {
+		case w.hasRunningJob(depStep):
+			// stopped steps are still running until we hear otherwise
+			finished = false
+		case depStep.Status == StatusSuccessful:
+		case stepDone(*depStep) && depStep.AllowFailure:
+			allowedFailure = true
+		case stepDone(*depStep) || depStep.Status == StatusNotRun || depStep.Status == StatusStopped:
+			failedDep = true
+		default:
+			finished = false
 		}
 	}
-	return true
+
+	if isOnSuccess(step.When) {
+		if w.pipeline.Status == StatusStopping || failedDep ||
+			(allowedFailure && !step.RunAfterAllowedFailure) {
+			return dependenciesUnsatisfiable
+		}
+		if !finished {
+			return dependenciesWaiting
+		}
+		return dependenciesSatisfied
+	}
+
+	if w.draining() {
+		return dependenciesUnsatisfiable
+	}
+	if !finished {
+		return dependenciesWaiting
+	}
+	cond, _, err := parseCondition(step.When)
+	if err != nil {
+		log.Errorf("Invalid condition for step %s of pipeline %d: %s", step.Name, w.pipeline.ID, err)
+		return dependenciesUnsatisfiable
+	}
+	if cond.eval(w) {
+		return dependenciesSatisfied
+	}
+	// the condition may become true later, if it doesn't
+	// the step is marked not run when the pipeline finishes
+	return dependenciesWaiting
+}
+
+func (w *worker) hasRunningJob(step *Step) bool {
+	for _, stepIndex := range w.runningJobs {
+		if w.pipeline.Steps[stepIndex] == step {
+			return true
+		}
+	}
+	return false
 }
 
-func (w *worker) allStepsDone() bool {
+// successStatus is the final status of a pipeline
+// which finished without stopping
+func (w *worker) successStatus() Status {
 	for _, step := range w.pipeline.Steps {
-		if !stepDone(*step) {
-			return false
+		if step.AllowFailure && stepDone(*step) && step.Status != StatusSuccessful {
+			return StatusSuccessfulWithWarnings
 		}
 	}
-	return true
+	return StatusSuccessful
+}
+
+func (w *worker) stepStatus(name string) Status {
+	if step, ok := w.steps[name]; ok {
+		return step.Status
+	}
+	return matrixStatus(w.pipeline.Steps, name)
+}
+
+func (w *worker) pipelineField(name string) string {
+	switch name {
+	case "status":
+		return string(w.pipeline.Status)
+	case "name":
+		return w.pipeline.Name
+	}
+	return ""
+}
+
+// jobOwner is who the webhooks of the step's current job are signed for
+func (w *worker) jobOwner(step *Step) jobOwner {
+	return jobOwner{pipelineID: w.pipeline.ID, step: step.Name, nonce: step.WebhookNonce}
+}
+
+func (w *worker) pipelineVar(name string) string {
+	return w.pipeline.Vars[name]
+}
+
+func (w *worker) failing() bool {
+	return w.pipeline.Status == StatusStopping
 }
 
 func stepDone(step Step) bool {
 	return step.Status == StatusSuccessful ||
 		step.Status == StatusFailed ||
-		step.Status == StatusError
+		step.Status == StatusError ||
+		step.Status == StatusTimedOut
+}
+
+func pipelineDone(pipeline Pipeline) bool {
+	return pipeline.Status == StatusSuccessful ||
+		pipeline.Status == StatusSuccessfulWithWarnings ||
+		pipeline.Status == StatusFailed ||
+		pipeline.Status == StatusError ||
+		pipeline.Status == StatusStopped ||
+		pipeline.Status == StatusCancelled ||
+		pipeline.Status == StatusTimedOut
 }
 
 func stepRunning(step Step) bool {
 	return step.Status == StatusRunning
 }
 
-func stepDoneOrRunning(step Step) bool {
-	return stepDone(step) || stepRunning(step)
+// stepAwaitingJob checks if a step has a job which
+// we have not yet received a final update for
+func stepAwaitingJob(step Step) bool {
+	return stepRunning(step) ||
+		((step.Status == StatusStopped || step.Status == StatusTimedOut) &&
+			step.EndTime.Equal(NotRunTime))
+}
+
+func jobDone(job dockworker.Job) bool {
+	return job.Status == dockworker.JobStatusSuccessful ||
+		job.Status == dockworker.JobStatusFailed ||
+		job.Status == dockworker.JobStatusError ||
+		job.Status == dockworker.JobStatusStopped
 }
 
 func (w *worker) cleanup() {
-	// unregister and empty the webhook channel
-	go func() {
-		for _ = range w.webhookChan {
-		}
-	}()
-	w.webhookListener.Unregister(w.webhookChan)
+	w.stopLock.Lock()
+	w.finished = true
+	w.stopLock.Unlock()
+	close(w.doneChan)
+	if w.pipelineTimer != nil {
+		w.pipelineTimer.Stop()
+	}
+	for jobID := range w.stepTimers {
+		w.stopStepTimer(jobID)
+	}
+	// stop routing updates for any jobs left running
+	for jobID := range w.runningJobs {
+		w.webhookListener.Unregister(jobID)
+		w.jobLimiter.Release(w.pipeline.ID)
+	}
+	w.jobLimiter.Withdraw(w.pipeline.ID)
 }
 
-func convertCmds(cmds []Cmd) []dockworker.Cmd {
+// convertCmds splits the commands into their arguments,
+// or runs each of them with sh -c if shell is set. The
+// references to vars are replaced after splitting, so
+// a value with spaces in is still a single argument. The
+// shell is given the values as its positional parameters.
+func convertCmds(cmds []Cmd, shell bool, vars map[string]string) ([]dockworker.Cmd, error) {
 	var converted []dockworker.Cmd
 	for _, c := range cmds {
-		converted = append(converted, strings.Split(string(c), " "))
+		if shell {
+			script, values := interpolateShell(string(c), vars)
+			// the first argument after the script is the shell's name
+			cmd := append(dockworker.Cmd{"sh", "-c", script, "sh"}, values...)
+			converted = append(converted, cmd)
+			continue
+		}
+		args, err := splitCommand(string(c))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse command %q: %s", c, err)
+		}
+		for i, arg := range args {
+			args[i] = interpolate(arg, vars)
+		}
+		converted = append(converted, args)
 	}
-	return converted
+	return converted, nil
 }
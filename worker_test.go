@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"os/exec"
 	"testing"
 
 	"github.com/bbokorney/dockworker"
@@ -8,12 +10,119 @@ import (
 )
 
 func TestConvertCmds(t *testing.T) {
-	cmds := []Cmd{"touch file.txt", "run.sh start stop", "ls"}
+	cmds := []Cmd{
+		"touch file.txt",
+		"run.sh start  stop",
+		"ls",
+		`bash -c "echo hi"`,
+		`echo 'it'\''s' "a \"b\" \c" '' x\ y`,
+		"grep -v \\n line\\\ncontinued",
+	}
 	expected := []dockworker.Cmd{
 		dockworker.Cmd{"touch", "file.txt"},
 		dockworker.Cmd{"run.sh", "start", "stop"},
 		dockworker.Cmd{"ls"},
+		dockworker.Cmd{"bash", "-c", "echo hi"},
+		dockworker.Cmd{"echo", "it's", `a "b" \c`, "", "x y"},
+		dockworker.Cmd{"grep", "-v", "n", "linecontinued"},
 	}
-	converted := convertCmds(cmds)
+	converted, err := convertCmds(cmds, false, nil)
+	assert.Nil(t, err, "Commands should be converted")
 	assert.Equal(t, expected, converted, "Converted commands should match")
+
+	converted, err = convertCmds([]Cmd{"ls | wc -l && echo done"}, true, nil)
+	assert.Nil(t, err, "Shell commands should be converted")
+	assert.Equal(t, []dockworker.Cmd{dockworker.Cmd{"sh", "-c", "ls | wc -l && echo done", "sh"}}, converted, "Shell commands should be run with sh")
+
+	for _, cmd := range []Cmd{`echo "hi`, "echo 'hi", `echo hi\`} {
+		_, err = convertCmds([]Cmd{cmd}, false, nil)
+		assert.NotNil(t, err, "Unterminated command %q should not be converted", cmd)
+	}
+
+	// the argv form is kept as a quoted command which splits back into it
+	var step Step
+	err = json.Unmarshal([]byte(`{"cmds": ["ls -la", ["echo", "it's", "", "a b"]]}`), &step)
+	assert.Nil(t, err, "Commands should be decoded")
+	assert.Equal(t, []Cmd{"ls -la", `echo 'it'\''s' '' 'a b'`}, step.Cmds, "Argument array should be quoted")
+	converted, err = convertCmds(step.Cmds, false, nil)
+	assert.Nil(t, err, "Decoded commands should be converted")
+	assert.Equal(t, dockworker.Cmd{"echo", "it's", "", "a b"}, converted[1], "Arguments should be unchanged")
+
+	// vars are filled in after splitting so their values aren't split
+	vars := map[string]string{"msg": "hello world", "tag": "0.0.1"}
+	converted, err = convertCmds([]Cmd{"echo ${msg} v${tag} $${HOME}"}, false, vars)
+	assert.Nil(t, err, "Commands with vars should be converted")
+	assert.Equal(t, []dockworker.Cmd{dockworker.Cmd{"echo", "hello world", "v0.0.1", "${HOME}"}}, converted, "Vars should be filled in")
+	converted, err = convertCmds([]Cmd{"echo ${msg} v${tag} $${HOME} ${msg}"}, true, vars)
+	assert.Nil(t, err, "Shell commands with vars should be converted")
+	assert.Equal(t, []dockworker.Cmd{dockworker.Cmd{"sh", "-c", `echo "${1}" v"${2}" ${HOME} "${1}"`, "sh", "hello world", "0.0.1"}},
+		converted, "Vars should be passed as parameters")
+
+	// the shell doesn't run what's in a value, which is
+	// a single word however the reference to it is quoted
+	vars = map[string]string{"value": "a  b; echo $(id) `id` it's \\ \"c\""}
+	var argv Cmd
+	assert.Nil(t, json.Unmarshal([]byte(`["printf", "[%s]", "x${value}"]`), &argv), "Command should be decoded")
+	for _, cmd := range []Cmd{`printf '[%s]' x${value}`, `printf "[%s]" "x${value}"`, `printf '[%s]' 'x'"${value}"`, argv} {
+		converted, err = convertCmds([]Cmd{cmd}, true, vars)
+		assert.Nil(t, err, "Shell command %q should be converted", cmd)
+		output, err := exec.Command(converted[0][0], converted[0][1:]...).Output()
+		assert.Nil(t, err, "Shell command %q should run", cmd)
+		assert.Equal(t, "[x"+vars["value"]+"]", string(output), "Shell command %q should get the value unchanged", cmd)
+	}
+}
+
+func TestSmallJournalUpdate(t *testing.T) {
+	webhookListener := NewWebhookListener(make(chan dockworker.Job), "http://pipeline/webhook", newWebhookAuth("secret"))
+	pipeline := Pipeline{
+		ID:    1,
+		Steps: []*Step{&Step{Name: "build", Status: StatusRunning, JobID: 7}},
+	}
+	w := NewWorker(pipeline, nil, webhookListener, nil, 0, NewJobLimiter(0, nil), 0).(*worker)
+	w.runningJobs[7] = 0
+
+	running := dockworker.Job{ID: 7, Status: dockworker.JobStatusRunning}
+	assert.True(t, w.journalUpdate(running, UpdateSourceWebhook), "First update should be applied")
+	// the store keeps a copy, which the worker mustn't change
+	stored := copySteps(*w.pipeline)
+	assert.False(t, w.journalUpdate(running, UpdateSourceWebhook), "Repeated update should not be applied")
+	assert.Equal(t, 1, stored.Journal[0].Deliveries, "Stored journal should not change")
+	successful := dockworker.Job{ID: 7, Status: dockworker.JobStatusSuccessful}
+	assert.True(t, w.journalUpdate(successful, UpdateSourcePoll), "Final update should be applied")
+
+	// once the job has finished nothing can change it
+	delete(w.runningJobs, 7)
+	assert.False(t, w.journalUpdate(successful, UpdateSourceWebhook), "Repeated final update should not be applied")
+	failed := dockworker.Job{ID: 7, Status: dockworker.JobStatusFailed}
+	assert.False(t, w.journalUpdate(failed, UpdateSourceWebhook), "Late update should not be applied")
+	assert.False(t, w.journalUpdate(dockworker.Job{ID: 8}, UpdateSourceWebhook), "Unknown job should not be applied")
+
+	journal := w.pipeline.Journal
+	if assert.Equal(t, 3, len(journal), "Each status should be journaled once") {
+		assert.Equal(t, 2, journal[0].Deliveries, "Repeated delivery should be counted")
+		assert.Equal(t, UpdateSourcePoll, journal[1].Source, "Source should be recorded")
+		assert.Equal(t, 2, journal[1].Deliveries, "Repeated delivery should be counted")
+		assert.Equal(t, "build", journal[2].Step, "Late update should be journaled for its step")
+		assert.False(t, journal[2].Applied, "Late update should not be applied")
+	}
+}
+
+func TestSmallWorkerStopRequests(t *testing.T) {
+	webhookListener := NewWebhookListener(make(chan dockworker.Job), "http://pipeline/webhook", newWebhookAuth("secret"))
+	pipeline := Pipeline{ID: 1, Steps: []*Step{&Step{Name: "build"}}}
+	w := NewWorker(pipeline, nil, webhookListener, nil, 0, NewJobLimiter(0, nil), 0).(*worker)
+
+	// a cancel made while a stop is pending isn't lost
+	w.Stop()
+	assert.Nil(t, w.Cancel(Cancellation{By: "alice"}), "Cancel should be accepted")
+	assert.Nil(t, w.Cancel(Cancellation{By: "bob"}), "Second cancel should be accepted")
+	assert.Equal(t, 1, len(w.stopChan), "Requests should be signalled once")
+	<-w.stopChan
+	if cancellation := w.takeStop(); assert.NotNil(t, cancellation, "Cancel should be handled") {
+		assert.Equal(t, "alice", cancellation.By, "First cancel should be kept")
+	}
+	assert.Nil(t, w.takeStop(), "Cancel should only be handled once")
+
+	w.cleanup()
+	assert.Equal(t, ErrWorkerDone, w.Cancel(Cancellation{By: "alice"}), "Finished worker should refuse cancel")
 }